@@ -1,37 +1,106 @@
 package conf
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/netip"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
 )
 
 var (
-	cfg  *Config
-	once sync.Once
+	cfg        atomic.Pointer[Config]
+	configPath string
+	once       sync.Once
+	reloadMu   sync.Mutex
 )
 
 // Get config Info
+//
+// The returned Config must be treated as read-only, Reload swaps in a new one
+// instead of modifying it.
 func Info() *Config {
-	if cfg == nil {
+	c := cfg.Load()
+	if c == nil {
 		panic("config not loaded: call df.LoadConfig(path) first")
 	}
-	return cfg
+	return c
 }
 
 func LoadConfig(path string) {
 	once.Do(func() {
 		c, err := load(path)
 		if err != nil {
-			log.Fatalf("failed load config error: %v\n", err)
+			slog.Error("failed to load config", "err", err)
+			os.Exit(1)
 		}
-		cfg = c
+		configPath = path
+		cfg.Store(c)
 	})
 }
 
+// Reload reads the config file again. The new config is only swapped in if it
+// is valid and apply accepts it, otherwise the current one stays and the error
+// is returned.
+func Reload(apply func(*Config) error) (*Config, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	c, err := load(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := apply(c); err != nil {
+		return nil, err
+	}
+	cfg.Store(c)
+	return c, nil
+}
+
+// Watch calls fn whenever the config file changes on disk, until ctx is done.
+func Watch(ctx context.Context, interval time.Duration, fn func()) {
+	stamp := func() string {
+		fi, err := os.Stat(configPath)
+		if err != nil {
+			return ""
+		}
+		return fmt.Sprintf("%d:%d", fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	last := stamp()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// editors often truncate and rewrite, skip the half-written state
+		cur := stamp()
+		if cur == last || cur == "" {
+			continue
+		}
+		last = cur
+		fn()
+	}
+}
+
 func load(path string) (*Config, error) {
 	file, err := os.Open(path)
 	if err != nil {
@@ -57,38 +126,667 @@ func load(path string) (*Config, error) {
 	return &cfg, nil
 }
 
+// validate checks cfg and fills in the json:"-" fields with the parsed form
+// of the settings next to them.
 func validate(cfg *Config) error {
 
-	if cfg.Options.Bootstrap != "" {
-		_, err := netip.ParseAddr(cfg.Options.Bootstrap)
-		if err != nil {
-			return fmt.Errorf("bootstrap must be a single IP address, got %q: %w", cfg.Options.Bootstrap, err)
-		}
+	if err := validateBootstrap("options.bootstrap", cfg.Options.Bootstrap); err != nil {
+		return err
 	}
-	if cfg.Server.Standard == 0 {
-		return fmt.Errorf("config port.standard is required")
+	if len(cfg.Server.Standard) == 0 {
+		return fmt.Errorf("config server.standard is required")
+	}
+	for _, l := range []struct {
+		name  string
+		addrs Listen
+		unix  bool
+	}{
+		{"server.standard", cfg.Server.Standard, true},
+		{"server.dot", cfg.Server.Dot, false},
+		{"server.doq", cfg.Server.Doq, false},
+		{"server.doh.listen", cfg.Server.Doh.Listen, false},
+		{"server.http.listen", cfg.Server.HTTP.Listen, false},
+	} {
+		if err := validateListen(l.name, l.addrs, l.unix); err != nil {
+			return err
+		}
 	}
 	if cfg.Panel.Port == 0 {
 		return fmt.Errorf("config port.panel is required")
 	}
+	if cfg.Server.UDP.Workers < 0 || cfg.Server.UDP.Sockets < 0 {
+		return fmt.Errorf("server.udp.workers and server.udp.sockets must not be negative")
+	}
+	if cfg.Server.DrainTimeout < 0 {
+		return fmt.Errorf("server.drain_timeout must not be negative")
+	}
+	if cfg.Server.UDP.Sockets > 1 && !cfg.Server.UDP.ReusePort {
+		return fmt.Errorf("server.udp.sockets > 1 requires server.udp.reuse_port")
+	}
+	for _, v := range cfg.Server.HTTP.TrustedProxies {
+		p, err := ParsePrefix(v)
+		if err != nil {
+			return fmt.Errorf("server.http.trusted_proxies %q: %w", v, err)
+		}
+		cfg.Server.HTTP.TrustedPrefixes = append(cfg.Server.HTTP.TrustedPrefixes, p)
+	}
+	if err := validateRateLimit("server.rate_limit", &cfg.Server.RateLimit); err != nil {
+		return err
+	}
+	for name, rl := range cfg.Server.RateLimits {
+		if !slices.Contains(Listeners, name) {
+			return fmt.Errorf("server.rate_limits: unknown listener %q, must be one of %v", name, Listeners)
+		}
+		if err := validateRateLimit("server.rate_limits."+name, &rl); err != nil {
+			return err
+		}
+		cfg.Server.RateLimits[name] = rl
+	}
+	if err := validateACL("server.acl", &cfg.Server.ACL); err != nil {
+		return err
+	}
+	for name, acl := range cfg.Server.ACLs {
+		if !slices.Contains(Listeners, name) {
+			return fmt.Errorf("server.acls: unknown listener %q, must be one of %v", name, Listeners)
+		}
+		if err := validateACL("server.acls."+name, &acl); err != nil {
+			return err
+		}
+		cfg.Server.ACLs[name] = acl
+	}
+	if err := validateBlock("block", &cfg.Block); err != nil {
+		return err
+	}
+	for i := range cfg.Server.Doh.Auth {
+		a := &cfg.Server.Doh.Auth[i]
+		if a.User == "" {
+			return fmt.Errorf("server.doh.auth: user is required")
+		}
+		for _, t := range a.QTypes {
+			qtype, ok := dns.StringToType[strings.ToUpper(t)]
+			if !ok {
+				return fmt.Errorf("server.doh.auth[%s].qtypes: unknown type %q", a.User, t)
+			}
+			a.Types = append(a.Types, qtype)
+		}
+		if a.RateLimit < 0 {
+			return fmt.Errorf("server.doh.auth[%s].rate_limit must not be negative", a.User)
+		}
+		if err := validateBlock(fmt.Sprintf("server.doh.auth[%s].block", a.User), &a.Block); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Upstream) == 0 {
+		return fmt.Errorf("upstream must not be empty")
+	}
+	if err := validateUpstreams("upstream", cfg.Upstream); err != nil {
+		return err
+	}
+	if err := validateRoutes(cfg); err != nil {
+		return err
+	}
+	if err := validateHosts(&cfg.Hosts); err != nil {
+		return err
+	}
+	if p := cfg.Options.Policy; p != "" && !slices.Contains(policies, p) {
+		return fmt.Errorf("options.policy must be one of %v, got %q", policies, p)
+	}
+	ttl := cfg.Options.TTL
+	if ttl.Min < 0 || ttl.Max < 0 || ttl.Overwrite < 0 {
+		return fmt.Errorf("options.ttl values must not be negative")
+	}
+	if ttl.Min > 0 && ttl.Max > 0 && ttl.Min > ttl.Max {
+		return fmt.Errorf("options.ttl.min (%d) must not be greater than options.ttl.max (%d)", ttl.Min, ttl.Max)
+	}
+	if ecs := &cfg.Options.EDNS0Subnet; ecs.Subnet != "" && ecs.Subnet != ECSClient {
+		p, err := ParsePrefix(ecs.Subnet)
+		if err != nil {
+			return fmt.Errorf("options.edns0_subnet must be a CIDR or %q, got %q: %w", ECSClient, ecs.Subnet, err)
+		}
+		ecs.Fixed = p
+	}
+	if p := cfg.Options.EDNS0Subnet.IPv4Prefix; p < 0 || p > 32 {
+		return fmt.Errorf("options.edns0_subnet.ipv4_prefix must be within 0-32, got %d", p)
+	}
+	if p := cfg.Options.EDNS0Subnet.IPv6Prefix; p < 0 || p > 128 {
+		return fmt.Errorf("options.edns0_subnet.ipv6_prefix must be within 0-128, got %d", p)
+	}
+	switch cfg.Options.EDNS0Subnet.Policy {
+	case "", ECSKeep, ECSReplace, ECSRemove:
+	default:
+		return fmt.Errorf("options.edns0_subnet.policy must be one of keep, replace, remove, got %q", cfg.Options.EDNS0Subnet.Policy)
+	}
+	switch strings.ToLower(cfg.Log.Level) {
+	case "", "debug", "info", "warn", "warning", "error":
+	default:
+		return fmt.Errorf("log.level must be one of debug, info, warn, error, got %q", cfg.Log.Level)
+	}
+	switch cfg.Log.Format {
+	case "", LogText, LogJSON:
+	default:
+		return fmt.Errorf("log.format must be text or json, got %q", cfg.Log.Format)
+	}
+	if cfg.Log.MaxSize < 0 || cfg.Log.MaxBackups < 0 {
+		return fmt.Errorf("log.max_size and log.max_backups must not be negative")
+	}
+	if cfg.QueryLog.Retention < 0 {
+		return fmt.Errorf("query_log.retention must not be negative")
+	}
+	hc := cfg.Options.HealthCheck
+	if hc.Interval < 0 || hc.Failures < 0 || hc.MaxBackoff < 0 {
+		return fmt.Errorf("options.health_check values must not be negative")
+	}
+	if hc.Name != "" {
+		if _, ok := dns.IsDomainName(hc.Name); !ok {
+			return fmt.Errorf("options.health_check.name: invalid domain %q", hc.Name)
+		}
+	}
+	if hc.Type != "" {
+		if _, ok := dns.StringToType[strings.ToUpper(hc.Type)]; !ok {
+			return fmt.Errorf("options.health_check.type: unknown type %q", hc.Type)
+		}
+	}
+	if d := cfg.Options.DNSSEC; d.Validate {
+		if d.TrustAnchor == "" {
+			return fmt.Errorf("options.dnssec.trust_anchor is required for validation")
+		}
+		if err := validateFile(d.TrustAnchor); err != nil {
+			return fmt.Errorf("options.dnssec.trust_anchor %q: %w", d.TrustAnchor, err)
+		}
+	}
+	if d := &cfg.Options.DNS64; d.Prefix != "" {
+		p, err := netip.ParsePrefix(d.Prefix)
+		if err != nil || !p.Addr().Is6() || p.Addr().Is4In6() {
+			return fmt.Errorf("options.dns64.prefix must be an IPv6 CIDR, got %q", d.Prefix)
+		}
+		if !slices.Contains([]int{32, 40, 48, 56, 64, 96}, p.Bits()) {
+			return fmt.Errorf("options.dns64.prefix length must be 32, 40, 48, 56, 64 or 96, got %d", p.Bits())
+		}
+		if p.Addr().As16()[8] != 0 {
+			return fmt.Errorf("options.dns64.prefix: bits 64 to 71 must be zero (RFC 6052)")
+		}
+		d.NAT64 = p.Masked()
+	}
+	for _, v := range cfg.Options.DNS64.Exclude {
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return fmt.Errorf("options.dns64.exclude %q: %w", v, err)
+		}
+		cfg.Options.DNS64.ExcludePrefixes = append(cfg.Options.DNS64.ExcludePrefixes, p.Masked())
+	}
+	for _, v := range cfg.Options.DNS64.ClientAddress {
+		p, err := ParsePrefix(v)
+		if err != nil {
+			return fmt.Errorf("options.dns64.client_address %q: %w", v, err)
+		}
+		cfg.Options.DNS64.ClientPrefixes = append(cfg.Options.DNS64.ClientPrefixes, p)
+	}
+	if cfg.Options.Cache.Size < 0 {
+		return fmt.Errorf("options.cache.size must not be negative, got %d", cfg.Options.Cache.Size)
+	}
+	if cfg.Options.Cache.NegativeTTL < 0 {
+		return fmt.Errorf("options.cache.negative_ttl must not be negative, got %d", cfg.Options.Cache.NegativeTTL)
+	}
+
+	return nil
+}
+
+func validateRoutes(cfg *Config) error {
+	for name, g := range cfg.UpstreamGroups {
+		if name == "" || name == DefaultGroup {
+			return fmt.Errorf("upstream_groups: %q is not a valid group name", name)
+		}
+		if len(g.Upstream) == 0 {
+			return fmt.Errorf("upstream_groups.%s.upstream must not be empty", name)
+		}
+		if err := validateUpstreams("upstream_groups."+name+".upstream", g.Upstream); err != nil {
+			return err
+		}
+		if g.Policy != "" && !slices.Contains(policies, g.Policy) {
+			return fmt.Errorf("upstream_groups.%s.policy must be one of %v, got %q", name, policies, g.Policy)
+		}
+		if err := validateBootstrap("upstream_groups."+name+".bootstrap", g.Bootstrap); err != nil {
+			return err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for i, r := range cfg.Routes {
+		if _, ok := cfg.UpstreamGroups[r.Group]; !ok && r.Group != DefaultGroup {
+			return fmt.Errorf("routes[%d]: unknown upstream group %q", i, r.Group)
+		}
+		if len(r.DomainSuffix) == 0 {
+			return fmt.Errorf("routes[%d].domain_suffix must not be empty", i)
+		}
+		for _, d := range r.DomainSuffix {
+			suffix := DomainSuffix(d)
+			if _, ok := dns.IsDomainName(suffix); !ok || suffix == "" {
+				return fmt.Errorf("routes[%d].domain_suffix: invalid domain %q", i, d)
+			}
+			if seen[suffix] {
+				return fmt.Errorf("routes[%d].domain_suffix: %q is routed twice", i, d)
+			}
+			seen[suffix] = true
+		}
+	}
+	return nil
+}
+
+func validateUpstreams(name string, ups []Upstream) error {
+	for i := range ups {
+		u := &ups[i]
+		at := fmt.Sprintf("%s[%d]", name, i)
+		uu, err := UpstreamURL(u.Address)
+		if err != nil || u.Address == "" {
+			return fmt.Errorf("%s: invalid address %q", at, u.Address)
+		}
+		if u.Timeout < 0 || u.Weight < 0 {
+			return fmt.Errorf("%s: timeout and weight must not be negative", at)
+		}
+		for _, v := range u.IPs {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				return fmt.Errorf("%s.ips: %w", at, err)
+			}
+			u.Addrs = append(u.Addrs, ip)
+		}
+		for _, v := range u.HTTPVersions {
+			if !slices.Contains(httpVersions, v) {
+				return fmt.Errorf("%s.http_versions must be some of %v, got %q", at, httpVersions, v)
+			}
+		}
+
+		t := u.TLS
+		secure := uu.Scheme == "tls" || uu.Scheme == "quic" || uu.Scheme == "https" || uu.Scheme == "h3"
+		if (t != UpstreamTLS{}) && !secure {
+			return fmt.Errorf("%s.tls: %s upstreams don't use TLS", at, uu.Scheme)
+		}
+		if t.ServerName != "" {
+			if _, ok := dns.IsDomainName(t.ServerName); !ok {
+				return fmt.Errorf("%s.tls.server_name: invalid name %q", at, t.ServerName)
+			}
+		}
+		if (t.ClientCert == "") != (t.ClientKey == "") {
+			return fmt.Errorf("%s.tls: client_cert and client_key go together", at)
+		}
+		if t.ClientCert != "" && (uu.Scheme == "quic" || uu.Scheme == "h3") {
+			return fmt.Errorf("%s.tls: client certificates are not supported with %s", at, uu.Scheme)
+		}
+	}
+	return nil
+}
+
+// validateListen checks the addresses of a listener, unix sockets are only
+// allowed if unix is set.
+func validateListen(name string, l Listen, unix bool) error {
+	seen := make(map[string]bool)
+	for _, v := range l {
+		if seen[v] {
+			return fmt.Errorf("%s: %q is listed twice", name, v)
+		}
+		seen[v] = true
+		if path, ok := strings.CutPrefix(v, UnixPrefix); ok {
+			if !unix {
+				return fmt.Errorf("%s: unix sockets are only supported by server.standard, got %q", name, v)
+			}
+			if !filepath.IsAbs(path) {
+				return fmt.Errorf("%s: %q needs an absolute path", name, v)
+			}
+			continue
+		}
+		host, port, err := net.SplitHostPort(v)
+		if err != nil {
+			return fmt.Errorf("%s %q: %w", name, v, err)
+		}
+		if host != "" {
+			if _, err := netip.ParseAddr(host); err != nil {
+				return fmt.Errorf("%s %q: host must be an IP: %w", name, v, err)
+			}
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%s %q: invalid port", name, v)
+		}
+	}
+	return nil
+}
+
+// validateBootstrap checks a bootstrap list: IPs, IP:port pairs or files in
+// resolv.conf format.
+func validateBootstrap(name string, b Bootstrap) error {
+	for _, v := range b {
+		if _, err := netip.ParseAddr(v); err == nil {
+			continue
+		}
+		if _, err := netip.ParseAddrPort(v); err == nil {
+			continue
+		}
+		if !strings.HasPrefix(v, "/") && !strings.HasPrefix(v, "file://") {
+			return fmt.Errorf("%s: %q is neither an IP, IP:port nor a resolv.conf path", name, v)
+		}
+		if err := validateFile(v); err != nil {
+			return fmt.Errorf("%s %q: %w", name, v, err)
+		}
+	}
+	return nil
+}
+
+func validateRateLimit(name string, rl *RateLimitConfig) error {
+	if rl.PerIP < 0 || rl.PerSubnet < 0 || rl.Burst < 0 {
+		return fmt.Errorf("%s values must not be negative", name)
+	}
+	if rl.IPv4Prefix < 0 || rl.IPv4Prefix > 32 {
+		return fmt.Errorf("%s.ipv4_prefix must be within 0-32, got %d", name, rl.IPv4Prefix)
+	}
+	if rl.IPv6Prefix < 0 || rl.IPv6Prefix > 128 {
+		return fmt.Errorf("%s.ipv6_prefix must be within 0-128, got %d", name, rl.IPv6Prefix)
+	}
+	if rl.Slip < -1 {
+		return fmt.Errorf("%s.slip must be -1 or more, got %d", name, rl.Slip)
+	}
+	for _, v := range rl.Allow {
+		p, err := ParsePrefix(v)
+		if err != nil {
+			return fmt.Errorf("%s.allow %q: %w", name, v, err)
+		}
+		rl.AllowPrefixes = append(rl.AllowPrefixes, p)
+	}
+	return nil
+}
+
+func validateACL(name string, acl *ACLConfig) error {
+	switch acl.Action {
+	case "", ACLRefused, ACLDrop:
+	default:
+		return fmt.Errorf("%s.action must be refused or drop, got %q", name, acl.Action)
+	}
+	for _, v := range acl.Allow {
+		p, err := ParsePrefix(v)
+		if err != nil {
+			return fmt.Errorf("%s %q: %w", name, v, err)
+		}
+		acl.AllowPrefixes = append(acl.AllowPrefixes, p)
+	}
+	for _, v := range acl.Deny {
+		p, err := ParsePrefix(v)
+		if err != nil {
+			return fmt.Errorf("%s %q: %w", name, v, err)
+		}
+		acl.DenyPrefixes = append(acl.DenyPrefixes, p)
+	}
+	return nil
+}
+
+func validateBlock(name string, b *BlockConfig) error {
+	for _, d := range b.DomainSuffix {
+		if suffix := DomainSuffix(d); suffix == "" {
+			return fmt.Errorf("%s.domain_suffix: invalid domain %q", name, d)
+		} else if _, ok := dns.IsDomainName(suffix); !ok {
+			return fmt.Errorf("%s.domain_suffix: invalid domain %q", name, d)
+		}
+	}
+	for _, v := range b.ClientAddress {
+		p, err := ParsePrefix(v)
+		if err != nil {
+			return fmt.Errorf("%s.client_address %q: %w", name, v, err)
+		}
+		b.ClientPrefixes = append(b.ClientPrefixes, p)
+	}
+	for _, v := range b.RuleSet {
+		if err := validateFile(v); err != nil {
+			return fmt.Errorf("%s.rule_set %q: %w", name, v, err)
+		}
+	}
+	switch b.Response {
+	case "", BlockNXDomain, BlockRefused, BlockSinkhole, BlockNoData:
+	default:
+		return fmt.Errorf("%s.response must be one of nxdomain, refused, sinkhole, nodata, got %q", name, b.Response)
+	}
+	return nil
+}
+
+// validateFile checks a file setting, which may be a path or a file:// url.
+func validateFile(v string) error {
+	_, err := FilePath(v)
+	return err
+}
+
+// FilePath turns a file setting into a local path. Both plain paths and
+// file:// URLs are accepted.
+func FilePath(s string) (string, error) {
+	if !strings.Contains(s, "://") {
+		return s, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("only local files and file:// urls are supported, got scheme %q", u.Scheme)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("remote file url %q is not supported", s)
+	}
+	return u.Path, nil
+}
 
+func validateHosts(h *HostsConfig) error {
+	if h.TTL < 0 {
+		return fmt.Errorf("hosts.ttl must not be negative")
+	}
+	for name, addrs := range h.Static {
+		if _, ok := dns.IsDomainName(name); !ok {
+			return fmt.Errorf("hosts.static: invalid name %q", name)
+		}
+		for _, a := range addrs {
+			addr, err := netip.ParseAddr(a)
+			if err != nil {
+				return fmt.Errorf("hosts.static[%s]: %w", name, err)
+			}
+			if h.StaticAddrs == nil {
+				h.StaticAddrs = make(map[string][]netip.Addr)
+			}
+			h.StaticAddrs[name] = append(h.StaticAddrs[name], addr)
+		}
+	}
+	for _, v := range h.Files {
+		if err := validateFile(v); err != nil {
+			return fmt.Errorf("hosts.files %q: %w", v, err)
+		}
+	}
+	for _, v := range h.Records {
+		rr, err := dns.NewRR(v)
+		if err != nil {
+			return fmt.Errorf("hosts.records %q: %w", v, err)
+		}
+		if rr == nil {
+			return fmt.Errorf("hosts.records: empty record")
+		}
+	}
 	return nil
 }
 
 func applyDefault(cfg *Config) {
-	if cfg.Options.Bootstrap == "" {
-		cfg.Options.Bootstrap = "8.8.8.8"
+	if len(cfg.Options.Bootstrap) == 0 {
+		cfg.Options.Bootstrap = Bootstrap{"8.8.8.8", "1.1.1.1"}
+	}
+	if cfg.Server.DrainTimeout == 0 {
+		cfg.Server.DrainTimeout = 10
+	}
+	if len(cfg.Server.Doh.Listen) == 0 && cfg.Server.Doh.Port != 0 {
+		cfg.Server.Doh.Listen = Listen{PortAddr(cfg.Server.Doh.Port)}
+	}
+	if len(cfg.Server.HTTP.Listen) == 0 && cfg.Server.HTTP.Port != 0 {
+		cfg.Server.HTTP.Listen = Listen{PortAddr(cfg.Server.HTTP.Port)}
+	}
+	if cfg.Server.Doh.Path == "" {
+		cfg.Server.Doh.Path = "/dns-query"
+	}
+	if cfg.Server.HTTP.Path == "" {
+		cfg.Server.HTTP.Path = "/dns-query"
+	}
+	if cfg.Server.UDP.Workers == 0 {
+		cfg.Server.UDP.Workers = 1024
+	}
+	if cfg.Server.UDP.Sockets == 0 {
+		cfg.Server.UDP.Sockets = 1
+		if cfg.Server.UDP.ReusePort {
+			cfg.Server.UDP.Sockets = runtime.NumCPU()
+		}
+	}
+	rateLimitDefaults(&cfg.Server.RateLimit)
+	for name, rl := range cfg.Server.RateLimits {
+		rateLimitDefaults(&rl)
+		cfg.Server.RateLimits[name] = rl
+	}
+	if cfg.Server.ACL.Action == "" {
+		cfg.Server.ACL.Action = ACLRefused
+	}
+	for name, acl := range cfg.Server.ACLs {
+		if acl.Action == "" {
+			acl.Action = ACLRefused
+		}
+		cfg.Server.ACLs[name] = acl
+	}
+	if cfg.Block.Response == "" {
+		cfg.Block.Response = BlockNXDomain
+	}
+	for i := range cfg.Server.Doh.Auth {
+		if cfg.Server.Doh.Auth[i].Block.Response == "" {
+			cfg.Server.Doh.Auth[i].Block.Response = cfg.Block.Response
+		}
+	}
+	if cfg.Options.Policy == "" {
+		cfg.Options.Policy = PolicyParallel
+	}
+	upstreamDefaults(cfg.Upstream)
+	for name, g := range cfg.UpstreamGroups {
+		upstreamDefaults(g.Upstream)
+		if g.Policy == "" {
+			g.Policy = cfg.Options.Policy
+		}
+		if len(g.Bootstrap) == 0 {
+			g.Bootstrap = cfg.Options.Bootstrap
+		}
+		cfg.UpstreamGroups[name] = g
+	}
+	if cfg.Options.EDNS0Subnet.IPv4Prefix == 0 {
+		cfg.Options.EDNS0Subnet.IPv4Prefix = 24
+	}
+	if cfg.Options.EDNS0Subnet.IPv6Prefix == 0 {
+		cfg.Options.EDNS0Subnet.IPv6Prefix = 56
+	}
+	if cfg.Options.EDNS0Subnet.Policy == "" {
+		cfg.Options.EDNS0Subnet.Policy = ECSKeep
+	}
+	if cfg.Options.Cache.Size == 0 {
+		cfg.Options.Cache.Size = 4096
+	}
+	if cfg.Options.Cache.NegativeTTL == 0 {
+		cfg.Options.Cache.NegativeTTL = 900
+	}
+	if cfg.Log.Level == "" {
+		cfg.Log.Level = "info"
+	}
+	if cfg.Log.Format == "" {
+		cfg.Log.Format = LogText
+	}
+	if cfg.Log.MaxSize == 0 {
+		cfg.Log.MaxSize = 100
+	}
+	if cfg.Log.MaxBackups == 0 {
+		cfg.Log.MaxBackups = 5
+	}
+	hc := &cfg.Options.HealthCheck
+	if hc.Interval == 0 {
+		hc.Interval = 10
+	}
+	if hc.Name == "" {
+		hc.Name = "."
+	}
+	if hc.Type == "" {
+		hc.Type = "NS"
+	}
+	if hc.Failures == 0 {
+		hc.Failures = 3
+	}
+	if hc.MaxBackoff == 0 {
+		hc.MaxBackoff = 300
+	}
+	if cfg.Options.DNS64.Prefix == "" {
+		cfg.Options.DNS64.Prefix = "64:ff9b::/96"
+		cfg.Options.DNS64.NAT64 = netip.MustParsePrefix(cfg.Options.DNS64.Prefix)
+	}
+	if len(cfg.Options.DNS64.Exclude) == 0 {
+		cfg.Options.DNS64.Exclude = []string{"::ffff:0:0/96"}
+		cfg.Options.DNS64.ExcludePrefixes = []netip.Prefix{netip.MustParsePrefix("::ffff:0:0/96")}
+	}
+	if cfg.Hosts.TTL == 0 {
+		cfg.Hosts.TTL = 300
+	}
+	if cfg.QueryLog.Retention == 0 {
+		cfg.QueryLog.Retention = 7
+	}
+}
+
+func rateLimitDefaults(rl *RateLimitConfig) {
+	if rl.IPv4Prefix == 0 {
+		rl.IPv4Prefix = 24
+	}
+	if rl.IPv6Prefix == 0 {
+		rl.IPv6Prefix = 56
+	}
+	if rl.Slip == 0 {
+		rl.Slip = 2
 	}
 }
 
+func upstreamDefaults(ups []Upstream) {
+	for i := range ups {
+		u := &ups[i]
+		if u.Timeout == 0 {
+			u.Timeout = 10
+		}
+		if u.Weight == 0 {
+			u.Weight = 1
+		}
+		if len(u.HTTPVersions) == 0 {
+			u.HTTPVersions = slices.Clone(httpVersions)
+		}
+	}
+}
+
+// ParsePrefix accepts either a CIDR or a bare IP, the latter becomes a
+// single-address prefix.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
 type Config struct {
 	Panel    PanelConfig  `json:"panel"`
 	TLS      TLSConfig    `json:"tls"`
 	Server   ServerConfig `json:"server"`
-	Upstream []string     `json:"upstream"`
-	Options  Options      `json:"options"`
-	Block    BlockConfig  `json:"block"`
-	Log      LogConfig    `json:"log"`
+	Upstream []Upstream   `json:"upstream"`
+	// UpstreamGroups are extra named upstream sets, Routes pick one by
+	// domain. Upstream is the "default" group.
+	UpstreamGroups map[string]UpstreamGroup `json:"upstream_groups"`
+	Routes         []Route                  `json:"routes"`
+	Options        Options                  `json:"options"`
+	Block          BlockConfig              `json:"block"`
+	Log            LogConfig                `json:"log"`
+	QueryLog       QueryLogConfig           `json:"query_log"`
+	Metrics        MetricsConfig            `json:"metrics"`
+	Hosts          HostsConfig              `json:"hosts"`
 }
 
 type PanelConfig struct {
@@ -96,6 +794,115 @@ type PanelConfig struct {
 	Auth AuthPanelConfig `json:"auth"`
 }
 
+// DefaultGroup names the upstream group built from Config.Upstream and
+// Options. Routes may use it to exempt a subdomain from a broader route.
+const DefaultGroup = "default"
+
+// UpstreamGroup is a named set of upstreams with its own policy and
+// bootstrap; empty ones fall back to Options.
+type UpstreamGroup struct {
+	Upstream  []Upstream `json:"upstream"`
+	Policy    Policy     `json:"policy"`
+	Bootstrap Bootstrap  `json:"bootstrap"`
+}
+
+// Upstream is one upstream server. It may also be written as a bare string,
+// which sets Address.
+type Upstream struct {
+	Address string  `json:"address"`
+	Label   string  `json:"label"`   // name in logs, metrics and stats, defaults to Address
+	Timeout float64 `json:"timeout"` // seconds, default 10
+	// Weight skews round_robin and random towards this upstream, default 1.
+	Weight int `json:"weight"`
+	// IPs pins the host of Address to these addresses. Empty resolves it
+	// through the bootstrap servers of the group.
+	IPs          []string     `json:"ips"`
+	Addrs        []netip.Addr `json:"-"` // IPs, parsed by validate
+	TLS          UpstreamTLS  `json:"tls"`
+	HTTPVersions []string     `json:"http_versions"` // DoH, in order of preference: h3, h2, http/1.1
+}
+
+// UpstreamTLS configures the TLS client of a tls://, quic:// or https://
+// upstream.
+type UpstreamTLS struct {
+	// ServerName is sent as SNI and verified instead of the host of Address.
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// ClientCert and ClientKey are PEM files for mutual TLS. Not supported
+	// with quic://, https:// then speaks HTTP/2 or HTTP/1.1 only.
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
+}
+
+var httpVersions = []string{"h3", "h2", "http/1.1"}
+
+func (u *Upstream) UnmarshalJSON(data []byte) error {
+	var addr string
+	if err := json.Unmarshal(data, &addr); err == nil {
+		*u = Upstream{Address: addr}
+		return nil
+	}
+
+	type plain Upstream
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(u))
+}
+
+// Name is the label of u, or its address.
+func (u Upstream) Name() string {
+	if u.Label != "" {
+		return u.Label
+	}
+	return u.Address
+}
+
+// UpstreamURL parses an upstream address, a bare host:port is plain DNS over
+// UDP.
+func UpstreamURL(addr string) (*url.URL, error) {
+	if !strings.Contains(addr, "://") {
+		return &url.URL{Scheme: "udp", Host: addr}, nil
+	}
+	return url.Parse(addr)
+}
+
+// Route sends the queries for DomainSuffix and the names below it to Group.
+// "*.cn", ".cn" and "cn" are the same suffix. The longest matching suffix
+// wins.
+type Route struct {
+	DomainSuffix []string `json:"domain_suffix"`
+	Group        string   `json:"group"`
+}
+
+// DomainSuffix normalizes a domain_suffix entry of a route or a block
+// section: "*.cn", ".cn" and "cn" are the same suffix.
+func DomainSuffix(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, "*")
+	return strings.Trim(s, ".")
+}
+
+// HostsConfig holds the local names Core answers itself, authoritatively and
+// with TTL, instead of asking an upstream.
+type HostsConfig struct {
+	TTL int `json:"ttl"`
+	// Static maps a name to its IPv4 and IPv6 addresses, PTR records are
+	// derived from them.
+	Static      map[string][]string     `json:"static"`
+	StaticAddrs map[string][]netip.Addr `json:"-"` // Static, parsed by validate
+	// Files in /etc/hosts format, paths or file:// urls.
+	Files []string `json:"files"`
+	// Records in zone file format, e.g. "mail.lan. MX 10 mx.lan.". TTL is
+	// the default of the records that don't set their own.
+	Records []string `json:"records"`
+}
+
+// MetricsConfig serves /metrics without authentication on its own port. The
+// panel always serves it behind the panel credentials.
+type MetricsConfig struct {
+	Port int `json:"port"`
+}
+
 type AuthPanelConfig struct {
 	User     string `json:"user"`
 	Password string `json:"password"`
@@ -107,33 +914,157 @@ type TLSConfig struct {
 }
 
 type ServerConfig struct {
-	Standard int        `json:"standard"` // TCP+UDP
-	Dot      int        `json:"dot"`      // DNS over TLS
-	Doq      int        `json:"doq"`      // DNS over QUIC
+	Standard Listen     `json:"standard"` // TCP+UDP, a unix: address is TCP only
+	UDP      UDPConfig  `json:"udp"`      // standard UDP tuning
+	Dot      Listen     `json:"dot"`      // DNS over TLS
+	Doq      Listen     `json:"doq"`      // DNS over QUIC
 	Doh      DohConfig  `json:"doh"`      // DNS over HTTPS
 	HTTP     HttpConfig `json:"http"`     // DNS over HTTP
+
+	DrainTimeout int `json:"drain_timeout"` // seconds to finish in-flight queries on stop
+
+	RateLimit  RateLimitConfig            `json:"rate_limit"`  // applies to every listener
+	RateLimits map[string]RateLimitConfig `json:"rate_limits"` // per listener, replaces rate_limit
+	ACL        ACLConfig                  `json:"acl"`         // applies to every listener
+	ACLs       map[string]ACLConfig       `json:"acls"`        // per listener, replaces acl
+}
+
+// Listeners names the query listeners, as used by the per listener settings.
+// standard covers both udp and tcp, which take precedence over it.
+var Listeners = []string{"standard", "udp", "tcp", "dot", "doq", "doh", "http"}
+
+// Limits returns the rate limits of the listener called name.
+func (s ServerConfig) Limits(name string) RateLimitConfig {
+	return perListener(s.RateLimits, s.RateLimit, name)
+}
+
+// Access returns the access control list of the listener called name.
+func (s ServerConfig) Access(name string) ACLConfig {
+	return perListener(s.ACLs, s.ACL, name)
+}
+
+func perListener[T any](m map[string]T, def T, name string) T {
+	if v, ok := m[name]; ok {
+		return v
+	}
+	if v, ok := m["standard"]; ok && (name == "udp" || name == "tcp") {
+		return v
+	}
+	return def
+}
+
+const (
+	ACLRefused = "refused"
+	ACLDrop    = "drop"
+)
+
+// ACLConfig decides which clients a listener serves. Deny wins over Allow, an
+// empty Allow lets in everyone not denied. With refused, a denied TCP or DoT
+// connection gets one REFUSED answer and is closed; DoQ refuses denied
+// clients at the QUIC level before the handshake whatever the action.
+type ACLConfig struct {
+	Allow  []string `json:"allow"`  // IP or CIDR
+	Deny   []string `json:"deny"`   // IP or CIDR
+	Action string   `json:"action"` // refused or drop, default refused
+
+	AllowPrefixes []netip.Prefix `json:"-"` // Allow, parsed by validate
+	DenyPrefixes  []netip.Prefix `json:"-"` // Deny, parsed by validate
+}
+
+// RateLimitConfig throttles clients with a token bucket per IP and one per
+// subnet. Queries over the limit are refused, on UDP they're dropped except
+// every Slip-th, which gets an empty truncated answer so a real client
+// retries over TCP.
+type RateLimitConfig struct {
+	PerIP      int      `json:"per_ip"`      // queries per second, 0 is unlimited
+	PerSubnet  int      `json:"per_subnet"`  // queries per second, 0 is unlimited
+	Burst      int      `json:"burst"`       // bucket size, at least the rate
+	IPv4Prefix int      `json:"ipv4_prefix"` // subnet size, default 24
+	IPv6Prefix int      `json:"ipv6_prefix"` // subnet size, default 56
+	Slip       int      `json:"slip"`        // default 2, 1 truncates all, -1 drops all
+	Allow      []string `json:"allow"`       // IP or CIDR never limited
+
+	AllowPrefixes []netip.Prefix `json:"-"` // Allow, parsed by validate
+}
+
+type UDPConfig struct {
+	Workers   int  `json:"workers"`    // max queries handled concurrently
+	ReusePort bool `json:"reuse_port"` // SO_REUSEPORT, one socket per Sockets
+	Sockets   int  `json:"sockets"`    // defaults to the number of CPUs
 }
 
 type DohConfig struct {
-	Port int           `json:"port"`
-	Path string        `json:"path"`
-	Auth []AuthDohItem `json:"auth"`
+	Port   int           `json:"port"`   // shorthand for listen on every interface
+	Listen Listen        `json:"listen"` // overrides port
+	Path   string        `json:"path"`
+	Auth   []AuthDohItem `json:"auth"`
 }
 type AuthDohItem struct {
-	User     string `json:"user"`
-	Password string `json:"password"`
+	User      string      `json:"user"`
+	Password  string      `json:"password"`
+	QTypes    []string    `json:"qtypes"`     // allowed query types, empty allows all
+	Types     []uint16    `json:"-"`          // QTypes, parsed by validate
+	Block     BlockConfig `json:"block"`      // applied on top of the global block section
+	RateLimit int         `json:"rate_limit"` // queries per second, 0 is unlimited
 }
 
 type HttpConfig struct {
-	Port int    `json:"port"`
-	Path string `json:"path"`
+	Port           int      `json:"port"`   // shorthand for listen on every interface
+	Listen         Listen   `json:"listen"` // overrides port
+	Path           string   `json:"path"`
+	TrustedProxies []string `json:"trusted_proxies"` // IP or CIDR allowed to set X-Forwarded-For / X-Real-IP
+
+	TrustedPrefixes []netip.Prefix `json:"-"` // TrustedProxies, parsed by validate
 }
 
 type Options struct {
-	TTL         TTLOptions `json:"ttl"`
-	EDNS0Subnet string     `json:"edns0_subnet"`
-	Policy      int        `json:"policy"`
-	Bootstrap   string     `json:"bootstrap"`
+	TTL         TTLOptions         `json:"ttl"`
+	EDNS0Subnet ECSOptions         `json:"edns0_subnet"`
+	Policy      Policy             `json:"policy"`
+	Bootstrap   Bootstrap          `json:"bootstrap"`
+	Cache       CacheOptions       `json:"cache"`
+	HealthCheck HealthCheckOptions `json:"health_check"`
+	DNSSEC      DNSSECOptions      `json:"dnssec"`
+	DNS64       DNS64Options       `json:"dns64"`
+}
+
+// DNS64Options synthesizes AAAA records from A records for clients behind
+// NAT64 (RFC 6147), embedding the IPv4 address in Prefix.
+type DNS64Options struct {
+	Enable bool   `json:"enable"`
+	Prefix string `json:"prefix"` // /32, /40, /48, /56, /64 or /96, default 64:ff9b::/96
+	// Exclude lists CIDRs left out: AAAA answers in an IPv6 range count as
+	// absent, A records in an IPv4 range aren't synthesized from. Defaults
+	// to ::ffff:0:0/96.
+	Exclude       []string `json:"exclude"`
+	ClientAddress []string `json:"client_address"` // IP or CIDR, empty applies to every client
+
+	NAT64           netip.Prefix   `json:"-"` // Prefix, parsed by validate
+	ExcludePrefixes []netip.Prefix `json:"-"` // Exclude, parsed by validate
+	ClientPrefixes  []netip.Prefix `json:"-"` // ClientAddress, parsed by validate
+}
+
+// DNSSECOptions turns on DNSSEC validation of upstream answers. Validated
+// answers get the AD bit, bogus ones become SERVFAIL. TrustAnchor is a file
+// with the root DS or DNSKEY records in zone file format, e.g.
+//
+//	. IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D
+type DNSSECOptions struct {
+	Validate    bool   `json:"validate"`
+	TrustAnchor string `json:"trust_anchor"` // path or file:// url
+}
+
+// HealthCheckOptions configures the probes sent to every upstream. After
+// Failures failed probes in a row an upstream is left out of selection until
+// a probe succeeds again; probes of an unhealthy upstream back off
+// exponentially from Interval up to MaxBackoff.
+type HealthCheckOptions struct {
+	Disable    bool   `json:"disable"`
+	Interval   int    `json:"interval"` // seconds
+	Name       string `json:"name"`     // query name
+	Type       string `json:"type"`     // query type
+	Failures   int    `json:"failures"`
+	MaxBackoff int    `json:"max_backoff"` // seconds
 }
 
 type TTLOptions struct {
@@ -142,13 +1073,161 @@ type TTLOptions struct {
 	Overwrite int `json:"overwrite"` // 重写 TTL
 }
 
+// Policy selects how queries are spread across upstreams.
+type Policy string
+
+const (
+	PolicyParallel   Policy = "parallel"    // query all, take the fastest answer
+	PolicyFailover   Policy = "failover"    // config order, next on error
+	PolicyRoundRobin Policy = "round_robin" // rotate, next on error
+	PolicyRandom     Policy = "random"      // random pick, next on error
+	PolicyFastest    Policy = "fastest"     // lowest EWMA latency
+)
+
+var policies = []Policy{PolicyParallel, PolicyFailover, PolicyRoundRobin, PolicyRandom, PolicyFastest}
+
+// UnmarshalJSON also accepts the old numeric form as an index into the policy
+// list above.
+func (p *Policy) UnmarshalJSON(data []byte) error {
+	var n int
+	if err := json.Unmarshal(data, &n); err == nil {
+		if n < 0 || n >= len(policies) {
+			return fmt.Errorf("unknown policy %d", n)
+		}
+		*p = policies[n]
+		return nil
+	}
+	return json.Unmarshal(data, (*string)(p))
+}
+
+// Bootstrap lists the plain DNS servers resolving upstream host names, tried
+// in order: IPs, IP:port pairs or resolv.conf files like /etc/resolv.conf.
+// It may also be written as a bare string.
+type Bootstrap []string
+
+// Listen lists the addresses a listener binds, host:port or unix:/path. A
+// port number alone binds every interface.
+type Listen []string
+
+// UnixPrefix marks a unix socket address in a Listen list.
+const UnixPrefix = "unix:"
+
+func (l *Listen) UnmarshalJSON(data []byte) error {
+	var port int
+	if err := json.Unmarshal(data, &port); err == nil {
+		*l = nil
+		if port != 0 {
+			*l = Listen{PortAddr(port)}
+		}
+		return nil
+	}
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*l = nil
+		if one != "" {
+			*l = Listen{one}
+		}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// PortAddr is the address binding port on every interface.
+func PortAddr(port int) string {
+	return fmt.Sprintf(":%d", port)
+}
+
+func (b *Bootstrap) UnmarshalJSON(data []byte) error {
+	var one string
+	if err := json.Unmarshal(data, &one); err == nil {
+		*b = nil
+		if one != "" {
+			*b = Bootstrap{one}
+		}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(b))
+}
+
+// ECSOptions configures EDNS Client Subnet (RFC 7871) on upstream queries.
+// It may also be written as a bare string, which sets Subnet.
+//
+// Queries without ECS get Subnet. Policy decides what happens to a query
+// that carries its own: keep forwards the client's option, replace sends
+// Subnet instead, and remove sends no ECS at all, for clients that opted out
+// of sharing their network.
+type ECSOptions struct {
+	Subnet     string `json:"subnet"`      // CIDR, or "client" to derive it from the client address
+	IPv4Prefix int    `json:"ipv4_prefix"` // "client" mode only
+	IPv6Prefix int    `json:"ipv6_prefix"` // "client" mode only
+	Policy     string `json:"policy"`      // keep, replace or remove, default keep
+
+	Fixed netip.Prefix `json:"-"` // Subnet parsed by validate, unless "client"
+}
+
+const (
+	ECSClient = "client"
+
+	ECSKeep    = "keep"
+	ECSReplace = "replace"
+	ECSRemove  = "remove"
+)
+
+func (o *ECSOptions) UnmarshalJSON(data []byte) error {
+	var subnet string
+	if err := json.Unmarshal(data, &subnet); err == nil {
+		*o = ECSOptions{Subnet: subnet}
+		return nil
+	}
+
+	type plain ECSOptions
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode((*plain)(o))
+}
+
+type CacheOptions struct {
+	Disable     bool   `json:"disable"`
+	Size        int    `json:"size"`         // max entries, LRU evicted
+	NegativeTTL int    `json:"negative_ttl"` // upper bound for NXDOMAIN/NODATA, seconds
+	Snapshot    string `json:"snapshot"`     // file the cache is saved to on shutdown and loaded from on start
+}
+
 type BlockConfig struct {
 	Domain        []string `json:"domain"`
-	DomainSuffix  []string `json:"domain_suffix"`
-	ClientAddress []string `json:"client_address"`
-	RuleSet       []string `json:"rule_set"`
+	DomainSuffix  []string `json:"domain_suffix"`  // "*.example.com" is the same as "example.com"
+	ClientAddress []string `json:"client_address"` // IP or CIDR
+	RuleSet       []string `json:"rule_set"`       // file path or file:// url
+	Response      string   `json:"response"`       // nxdomain, refused, sinkhole, nodata
+
+	ClientPrefixes []netip.Prefix `json:"-"` // ClientAddress, parsed by validate
 }
 
+const (
+	BlockNXDomain = "nxdomain"
+	BlockRefused  = "refused"
+	BlockSinkhole = "sinkhole"
+	BlockNoData   = "nodata"
+)
+
 type LogConfig struct {
-	Level string `json:"level"`
+	Level  string `json:"level"`  // debug, info, warn, error
+	Format string `json:"format"` // text or json
+	// File is written instead of stderr when set. It's rotated once it grows
+	// beyond MaxSize megabytes, keeping MaxBackups old files.
+	File       string `json:"file"`
+	MaxSize    int    `json:"max_size"`
+	MaxBackups int    `json:"max_backups"`
+}
+
+// QueryLogConfig enables the persistent query log: one JSONL file per day in
+// Dir, files older than Retention days are removed.
+type QueryLogConfig struct {
+	Dir       string `json:"dir"`
+	Retention int    `json:"retention"`
 }
+
+const (
+	LogText = "text"
+	LogJSON = "json"
+)
@@ -1 +1,314 @@
 package conf
+
+import (
+	"encoding/json"
+	"net/netip"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestValidateBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		block   BlockConfig
+		clients []string // parsed client_address
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "wildcard suffix", block: BlockConfig{DomainSuffix: []string{"*.ads.example", ".ads.example", "ads.example."}}},
+		{name: "bare wildcard", block: BlockConfig{DomainSuffix: []string{"*"}}, wantErr: true},
+		{name: "root suffix", block: BlockConfig{DomainSuffix: []string{"."}}, wantErr: true},
+		{name: "client address", block: BlockConfig{ClientAddress: []string{"192.0.2.1", "198.51.100.7/24", "2001:db8::/32"}},
+			clients: []string{"192.0.2.1/32", "198.51.100.0/24", "2001:db8::/32"}},
+		{name: "bad client address", block: BlockConfig{ClientAddress: []string{"192.0.2.300"}}, wantErr: true},
+		{name: "response", block: BlockConfig{Response: BlockSinkhole}},
+		{name: "bad response", block: BlockConfig{Response: "drop"}, wantErr: true},
+		{name: "remote rule set", block: BlockConfig{RuleSet: []string{"https://example.com/list.txt"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateBlock("block", &tt.block)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateBlock = %v, want error %t", err, tt.wantErr)
+			}
+			var want []netip.Prefix
+			for _, s := range tt.clients {
+				want = append(want, netip.MustParsePrefix(s))
+			}
+			if !tt.wantErr && !slices.Equal(tt.block.ClientPrefixes, want) {
+				t.Errorf("ClientPrefixes = %v, want %v", tt.block.ClientPrefixes, want)
+			}
+		})
+	}
+}
+
+func TestDomainSuffix(t *testing.T) {
+	for _, s := range []string{"*.Ads.Example", ".ads.example", "ads.example.", " ads.example "} {
+		if got := DomainSuffix(s); got != "ads.example" {
+			t.Errorf("DomainSuffix(%q) = %q, want ads.example", s, got)
+		}
+	}
+}
+
+func TestECSOptionsUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ECSOptions
+		wantErr bool
+	}{
+		// the old form is the subnet alone
+		{in: `"client"`, want: ECSOptions{Subnet: ECSClient}},
+		{in: `"198.51.100.0/24"`, want: ECSOptions{Subnet: "198.51.100.0/24"}},
+		{in: `""`, want: ECSOptions{}},
+		{in: `{"subnet": "client", "ipv4_prefix": 20, "ipv6_prefix": 48, "policy": "replace"}`,
+			want: ECSOptions{Subnet: ECSClient, IPv4Prefix: 20, IPv6Prefix: 48, Policy: ECSReplace}},
+		{in: `{"subnet": "client", "ipv4": 20}`, wantErr: true},
+		{in: `24`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var got ECSOptions
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("Unmarshal(%s) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Policy
+		wantErr bool
+	}{
+		// the old form is an index into the policy list
+		{in: `0`, want: PolicyParallel},
+		{in: `1`, want: PolicyFailover},
+		{in: `4`, want: PolicyFastest},
+		{in: `5`, wantErr: true},
+		{in: `-1`, wantErr: true},
+		{in: `"round_robin"`, want: PolicyRoundRobin},
+		{in: `""`, want: ""},
+		{in: `true`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var got Policy
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Unmarshal(%s) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   HostsConfig
+		want    map[string][]netip.Addr
+		wantErr bool
+	}{
+		{name: "static", hosts: HostsConfig{Static: map[string][]string{"router.lan": {"192.0.2.1", "2001:db8::1"}}},
+			want: map[string][]netip.Addr{"router.lan": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}}},
+		{name: "bad address", hosts: HostsConfig{Static: map[string][]string{"router.lan": {"192.0.2"}}}, wantErr: true},
+		{name: "bad name", hosts: HostsConfig{Static: map[string][]string{"a..lan": {"192.0.2.1"}}}, wantErr: true},
+		{name: "record", hosts: HostsConfig{Records: []string{"mail.lan. MX 10 router.lan."}}},
+		{name: "bad record", hosts: HostsConfig{Records: []string{"mail.lan. MX router.lan."}}, wantErr: true},
+		{name: "negative ttl", hosts: HostsConfig{TTL: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateHosts(&tt.hosts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateHosts = %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(tt.hosts.StaticAddrs) != len(tt.want) {
+				t.Fatalf("StaticAddrs = %v, want %v", tt.hosts.StaticAddrs, tt.want)
+			}
+			for name, addrs := range tt.want {
+				if !slices.Equal(tt.hosts.StaticAddrs[name], addrs) {
+					t.Errorf("StaticAddrs[%s] = %v, want %v", name, tt.hosts.StaticAddrs[name], addrs)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []Upstream
+		wantErr bool
+	}{
+		// the old form is a list of addresses
+		{in: `["8.8.8.8:53", "tls://dns.example"]`, want: []Upstream{{Address: "8.8.8.8:53"}, {Address: "tls://dns.example"}}},
+		{in: `["1.1.1.1", {"address": "https://dns.example/dns-query", "label": "doh", "weight": 2, "ips": ["192.0.2.1"]}]`,
+			want: []Upstream{{Address: "1.1.1.1"}, {Address: "https://dns.example/dns-query", Label: "doh", Weight: 2, IPs: []string{"192.0.2.1"}}}},
+		{in: `[{"address": "1.1.1.1", "timout": 5}]`, wantErr: true},
+		{in: `[53]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var got []Upstream
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Unmarshal(%s) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateUpstreams(t *testing.T) {
+	ups := []Upstream{
+		{Address: "1.1.1.1:53"},
+		{Address: "tls://dns.example", IPs: []string{"192.0.2.1", "2001:db8::1"}},
+	}
+	if err := validateUpstreams("upstream", ups); err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+	if ups[0].Addrs != nil || !slices.Equal(ups[1].Addrs, want) {
+		t.Errorf("Addrs = %v, %v, want nil, %v", ups[0].Addrs, ups[1].Addrs, want)
+	}
+
+	for _, u := range []Upstream{
+		{Address: ""},
+		{Address: "tls://dns.example", IPs: []string{"dns.example"}},
+		{Address: "8.8.8.8:53", TLS: UpstreamTLS{ServerName: "dns.example"}},
+		{Address: "tls://dns.example", TLS: UpstreamTLS{ClientCert: "cert.pem"}},
+		{Address: "https://dns.example/dns-query", HTTPVersions: []string{"h4"}},
+		{Address: "8.8.8.8:53", Weight: -1},
+	} {
+		if err := validateUpstreams("upstream", []Upstream{u}); err == nil {
+			t.Errorf("validateUpstreams(%+v) = nil, want an error", u)
+		}
+	}
+}
+
+func TestBootstrapUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Bootstrap
+		wantErr bool
+	}{
+		// the old form is a single server
+		{in: `"8.8.8.8"`, want: Bootstrap{"8.8.8.8"}},
+		{in: `""`, want: nil},
+		{in: `["1.1.1.1", "9.9.9.9:5353", "/etc/resolv.conf"]`, want: Bootstrap{"1.1.1.1", "9.9.9.9:5353", "/etc/resolv.conf"}},
+		{in: `[]`, want: Bootstrap{}},
+		{in: `53`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var got Bootstrap
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateBootstrap(t *testing.T) {
+	tests := []struct {
+		in      Bootstrap
+		wantErr bool
+	}{
+		{in: Bootstrap{"8.8.8.8", "2001:4860:4860::8888", "[2001:4860:4860::8888]:53", "1.1.1.1:5353"}},
+		{in: Bootstrap{"/etc/resolv.conf", "file:///etc/resolv.conf"}},
+		{in: Bootstrap{"dns.google"}, wantErr: true},
+		{in: Bootstrap{"https://example.com/resolv.conf"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateBootstrap("options.bootstrap", tt.in); (err != nil) != tt.wantErr {
+			t.Errorf("validateBootstrap(%v) = %v, want error %t", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestValidateRateLimit(t *testing.T) {
+	rl := RateLimitConfig{PerIP: 10, Allow: []string{"192.0.2.1", "2001:db8::/32"}}
+	if err := validateRateLimit("server.rate_limit", &rl); err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("192.0.2.1/32"), netip.MustParsePrefix("2001:db8::/32")}
+	if !slices.Equal(rl.AllowPrefixes, want) {
+		t.Errorf("AllowPrefixes = %v, want %v", rl.AllowPrefixes, want)
+	}
+
+	for _, rl := range []RateLimitConfig{
+		{PerIP: -1},
+		{IPv4Prefix: 33},
+		{IPv6Prefix: 129},
+		{Slip: -2},
+		{Allow: []string{"192.0.2.0/33"}},
+	} {
+		if err := validateRateLimit("server.rate_limit", &rl); err == nil {
+			t.Errorf("validateRateLimit(%+v) = nil, want an error", rl)
+		}
+	}
+}
+
+func TestListenUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Listen
+		wantErr bool
+	}{
+		// the old form is a port number
+		{in: `53`, want: Listen{":53"}},
+		{in: `0`, want: nil},
+		{in: `"127.0.0.1:53"`, want: Listen{"127.0.0.1:53"}},
+		{in: `""`, want: nil},
+		{in: `["127.0.0.1:53", "[::1]:53", "unix:/run/df.sock"]`, want: Listen{"127.0.0.1:53", "[::1]:53", "unix:/run/df.sock"}},
+		{in: `true`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var got Listen
+		err := json.Unmarshal([]byte(tt.in), &got)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Unmarshal(%s) = %v, want error %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestValidateListen(t *testing.T) {
+	tests := []struct {
+		in      Listen
+		unix    bool
+		wantErr bool
+	}{
+		{in: Listen{":53", "127.0.0.1:5353", "[::1]:53"}},
+		{in: Listen{"unix:/run/df.sock"}, unix: true},
+		{in: Listen{"unix:/run/df.sock"}, wantErr: true},
+		{in: Listen{"unix:df.sock"}, unix: true, wantErr: true},
+		{in: Listen{":53", ":53"}, wantErr: true},
+		{in: Listen{"localhost:53"}, wantErr: true},
+		{in: Listen{":0"}, wantErr: true},
+		{in: Listen{":65536"}, wantErr: true},
+		{in: Listen{"127.0.0.1"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := validateListen("server.standard", tt.in, tt.unix); (err != nil) != tt.wantErr {
+			t.Errorf("validateListen(%v, %t) = %v, want error %t", tt.in, tt.unix, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+const blockTTL = 60
+
+// blocker matches queries against the `block` config section.
+type blocker struct {
+	scope    string // "" for the global section, "user:<name>" for a DoH user's
+	sources  []*ruleSource
+	response string
+}
+
+// ruleSource is a group of rules that can be switched off at runtime: the
+// inline domain, domain_suffix and client_address lists and every rule set
+// file are one source each.
+type ruleSource struct {
+	name     string
+	domains  map[string]struct{}
+	suffixes *suffixTrie
+	allow    *suffixTrie // @@ exceptions, they apply to every source
+	clients  []netip.Prefix
+	rules    int
+}
+
+func newRuleSource(name string) *ruleSource {
+	return &ruleSource{
+		name:     name,
+		domains:  make(map[string]struct{}),
+		suffixes: newSuffixTrie(),
+		allow:    newSuffixTrie(),
+	}
+}
+
+func newBlocker(scope string, cfg conf.BlockConfig) (*blocker, error) {
+	b := &blocker{scope: scope, response: cfg.Response}
+
+	if len(cfg.Domain) > 0 {
+		src := newRuleSource("domain")
+		for _, d := range cfg.Domain {
+			src.addDomain(normalizeDomain(d))
+		}
+		b.sources = append(b.sources, src)
+	}
+	if len(cfg.DomainSuffix) > 0 {
+		src := newRuleSource("domain_suffix")
+		for _, d := range cfg.DomainSuffix {
+			src.addSuffix(conf.DomainSuffix(d))
+		}
+		b.sources = append(b.sources, src)
+	}
+	if len(cfg.ClientPrefixes) > 0 {
+		src := newRuleSource("client_address")
+		src.clients = cfg.ClientPrefixes
+		src.rules = len(cfg.ClientPrefixes)
+		b.sources = append(b.sources, src)
+	}
+	for _, s := range cfg.RuleSet {
+		path, err := conf.FilePath(s)
+		if err != nil {
+			return nil, fmt.Errorf("rule set %q: %w", s, err)
+		}
+		src := newRuleSource(s)
+		if err := src.loadRuleSet(path); err != nil {
+			return nil, fmt.Errorf("rule set %q: %w", s, err)
+		}
+		b.sources = append(b.sources, src)
+	}
+	return b, nil
+}
+
+func (s *ruleSource) addDomain(d string) {
+	s.domains[d] = struct{}{}
+	s.rules++
+}
+
+func (s *ruleSource) addSuffix(d string) {
+	s.suffixes.insert(d)
+	s.rules++
+}
+
+func (s *ruleSource) addException(d string) {
+	s.allow.insert(d)
+	s.rules++
+}
+
+// match reports whether the query from client for qname must be blocked, and
+// by which rule source. Sources switched off with SetRuleSource are skipped.
+func (b *blocker) match(qname string, client netip.Addr) (string, bool) {
+	disabled := b.disabled()
+
+	if client.IsValid() {
+		for _, src := range b.sources {
+			if disabled[src.name] {
+				continue
+			}
+			for _, p := range src.clients {
+				if p.Contains(client) {
+					return src.name, true
+				}
+			}
+		}
+	}
+
+	name := normalizeDomain(qname)
+	for _, src := range b.sources {
+		if !disabled[src.name] && src.allow.match(name) {
+			return "", false
+		}
+	}
+	for _, src := range b.sources {
+		if disabled[src.name] {
+			continue
+		}
+		if _, ok := src.domains[name]; ok {
+			return src.name, true
+		}
+		if src.suffixes.match(name) {
+			return src.name, true
+		}
+	}
+	return "", false
+}
+
+// reply builds the configured blocked response for req.
+func (b *blocker) reply(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	switch b.response {
+	case conf.BlockRefused:
+		return resp.SetRcode(req, dns.RcodeRefused)
+	case conf.BlockNXDomain:
+		return resp.SetRcode(req, dns.RcodeNameError)
+	}
+
+	resp.SetReply(req)
+	if b.response != conf.BlockSinkhole || len(req.Question) != 1 {
+		return resp
+	}
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: q.Qclass, Ttl: blockTTL}
+	switch q.Qtype {
+	case dns.TypeA:
+		resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+	case dns.TypeAAAA:
+		resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+	}
+	return resp
+}
+
+// normalizeDomain lower-cases d and strips the trailing dot.
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
+
+// suffixTrie stores domains by reversed labels, so "example.com" matches
+// itself and every name below it.
+type suffixTrie struct {
+	children map[string]*suffixTrie
+	end      bool
+}
+
+func newSuffixTrie() *suffixTrie {
+	return &suffixTrie{children: make(map[string]*suffixTrie)}
+}
+
+func (t *suffixTrie) insert(domain string) {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" {
+		return
+	}
+	node := t
+	labels := strings.Split(domain, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		next, ok := node.children[labels[i]]
+		if !ok {
+			next = newSuffixTrie()
+			node.children[labels[i]] = next
+		}
+		node = next
+	}
+	node.end = true
+}
+
+func (t *suffixTrie) match(domain string) bool {
+	node := t
+	for domain != "" {
+		i := strings.LastIndexByte(domain, '.')
+		label := domain[i+1:]
+		if i < 0 {
+			domain = ""
+		} else {
+			domain = domain[:i]
+		}
+
+		next, ok := node.children[label]
+		if !ok {
+			return false
+		}
+		if next.end {
+			return true
+		}
+		node = next
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"net/netip"
+	"testing"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+func TestSetRuleSourceScope(t *testing.T) {
+	cfg := conf.BlockConfig{Domain: []string{"ads.example.com"}}
+	global, err := newBlocker("", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := newBlocker("user:alice", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetRuleSource("domain", false)
+	defer SetRuleSource("domain", true)
+
+	if _, ok := global.match("ads.example.com.", netip.Addr{}); ok {
+		t.Error("switched off global source still blocks")
+	}
+	if src, ok := user.match("ads.example.com.", netip.Addr{}); !ok || src != "domain" {
+		t.Errorf("user source = %q, %t, want it untouched by the global switch", src, ok)
+	}
+
+	SetRuleSource("domain", true)
+	if _, ok := global.match("ads.example.com.", netip.Addr{}); !ok {
+		t.Error("switched on global source doesn't block")
+	}
+}
+
+func TestBlockerMatch(t *testing.T) {
+	b, err := newBlocker("", conf.BlockConfig{
+		Domain:       []string{"Exact.Example.com."},
+		DomainSuffix: []string{"*.ads.example", ".track.example", "bad.example"},
+		ClientPrefixes: []netip.Prefix{
+			netip.MustParsePrefix("192.0.2.0/24"),
+			netip.MustParsePrefix("2001:db8::1/128"),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := newRuleSource("rules")
+	for _, line := range []string{
+		"0.0.0.0 hosts.example",
+		"*.list.example",
+		"||adblock.example^",
+		"@@||ok.bad.example^",
+	} {
+		src.addRule(line)
+	}
+	b.sources = append(b.sources, src)
+
+	tests := []struct {
+		qname  string
+		client string
+		want   string // "" isn't blocked
+	}{
+		{"exact.example.com.", "", "domain"},
+		{"EXACT.example.com.", "", "domain"},
+		{"sub.exact.example.com.", "", ""},
+		{"ads.example.", "", "domain_suffix"},
+		{"x.ads.example.", "", "domain_suffix"},
+		{"x.track.example.", "", "domain_suffix"},
+		{"bad.example.", "", "domain_suffix"},
+		{"notbad.example.", "", ""},
+		{"ok.bad.example.", "", ""},
+		{"deep.ok.bad.example.", "", ""},
+		{"hosts.example.", "", "rules"},
+		{"sub.hosts.example.", "", ""},
+		{"list.example.", "", "rules"},
+		{"a.list.example.", "", "rules"},
+		{"a.adblock.example.", "", "rules"},
+		{"good.example.", "192.0.2.7", "client_address"},
+		{"good.example.", "2001:db8::1", "client_address"},
+		{"good.example.", "2001:db8::2", ""},
+		// a client match goes before the exceptions
+		{"ok.bad.example.", "192.0.2.7", "client_address"},
+	}
+	for _, tt := range tests {
+		var client netip.Addr
+		if tt.client != "" {
+			client = netip.MustParseAddr(tt.client)
+		}
+		src, ok := b.match(tt.qname, client)
+		if ok != (tt.want != "") || src != tt.want {
+			t.Errorf("match(%s, %s) = %q, %t, want %q", tt.qname, tt.client, src, ok, tt.want)
+		}
+	}
+}
+
+func TestBlockerReply(t *testing.T) {
+	tests := []struct {
+		response string
+		qtype    uint16
+		rcode    int
+		answer   string // "" has no answer
+	}{
+		{conf.BlockNXDomain, dns.TypeA, dns.RcodeNameError, ""},
+		{conf.BlockRefused, dns.TypeA, dns.RcodeRefused, ""},
+		{conf.BlockNoData, dns.TypeA, dns.RcodeSuccess, ""},
+		{conf.BlockSinkhole, dns.TypeA, dns.RcodeSuccess, "0.0.0.0"},
+		{conf.BlockSinkhole, dns.TypeAAAA, dns.RcodeSuccess, "::"},
+		{conf.BlockSinkhole, dns.TypeMX, dns.RcodeSuccess, ""},
+	}
+	for _, tt := range tests {
+		b := &blocker{response: tt.response}
+		req := new(dns.Msg).SetQuestion("ads.example.com.", tt.qtype)
+		resp := b.reply(req)
+		if resp.Id != req.Id || resp.Rcode != tt.rcode {
+			t.Errorf("%s %s: id %d rcode %s, want %d %s", tt.response, dns.TypeToString[tt.qtype],
+				resp.Id, dns.RcodeToString[resp.Rcode], req.Id, dns.RcodeToString[tt.rcode])
+		}
+		var got string
+		for _, rr := range resp.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = rr.A.String()
+			case *dns.AAAA:
+				got = rr.AAAA.String()
+			}
+			if rr.Header().Ttl != blockTTL || rr.Header().Name != "ads.example.com." {
+				t.Errorf("%s %s: answer %s", tt.response, dns.TypeToString[tt.qtype], rr)
+			}
+		}
+		if len(resp.Answer) > 1 || got != tt.answer {
+			t.Errorf("%s %s: answer %v, want %q", tt.response, dns.TypeToString[tt.qtype], resp.Answer, tt.answer)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"df/conf"
+
+	UP "github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+const (
+	bootstrapTimeout = 2 * time.Second
+	// bootstrapMinTTL and bootstrapMaxTTL bound how long resolved upstream
+	// addresses are used before they're refreshed.
+	bootstrapMinTTL = 30 * time.Second
+	bootstrapMaxTTL = time.Hour
+	// bootstrapRetry is the wait after a failed refresh.
+	bootstrapRetry = 10 * time.Second
+)
+
+// bootstrapServers expands a bootstrap list into the host:port addresses of
+// its servers.
+func bootstrapServers(b conf.Bootstrap) ([]string, error) {
+	var out []string
+	for _, v := range b {
+		if ip, err := netip.ParseAddr(v); err == nil {
+			out = append(out, netip.AddrPortFrom(ip, 53).String())
+			continue
+		}
+		if ap, err := netip.ParseAddrPort(v); err == nil {
+			out = append(out, ap.String())
+			continue
+		}
+		path, err := conf.FilePath(v)
+		if err != nil {
+			return nil, err
+		}
+		cc, err := dns.ClientConfigFromFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap %s: %w", v, err)
+		}
+		for _, s := range cc.Servers {
+			out = append(out, net.JoinHostPort(s, cc.Port))
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no bootstrap servers")
+	}
+	return out, nil
+}
+
+// bootstrapResolver resolves upstream host names through plain DNS servers,
+// falling back to the next one when a server fails. Addresses are cached
+// and refreshed in the background when their TTL runs out; until a refresh
+// succeeds the old ones stay in use.
+type bootstrapResolver struct {
+	servers []string
+	ctx     context.Context
+	stop    context.CancelFunc
+
+	mu    sync.Mutex
+	addrs map[string][]netip.Addr
+}
+
+var _ UP.Resolver = (*bootstrapResolver)(nil)
+
+func newBootstrapResolver(servers []string) *bootstrapResolver {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &bootstrapResolver{
+		servers: servers,
+		ctx:     ctx,
+		stop:    cancel,
+		addrs:   make(map[string][]netip.Addr),
+	}
+}
+
+func (r *bootstrapResolver) LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error) {
+	r.mu.Lock()
+	addrs, ok := r.addrs[host]
+	r.mu.Unlock()
+
+	if !ok {
+		var ttl time.Duration
+		var err error
+		addrs, ttl, err = r.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		if _, ok := r.addrs[host]; !ok {
+			go r.refresh(host, ttl)
+		}
+		r.addrs[host] = addrs
+		r.mu.Unlock()
+	}
+
+	var out []netip.Addr
+	for _, a := range addrs {
+		if network == "ip" || (network == "ip4") == a.Is4() {
+			out = append(out, a)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("bootstrap: no %s address for %s", network, host)
+	}
+	return out, nil
+}
+
+// refresh resolves host again whenever its TTL runs out, until the resolver
+// is closed.
+func (r *bootstrapResolver) refresh(host string, ttl time.Duration) {
+	timer := time.NewTimer(ttl)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		addrs, next, err := r.resolve(r.ctx, host)
+		if r.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("bootstrap refresh failed, keeping the old addresses", "host", host, "err", err)
+			next = bootstrapRetry
+		} else {
+			r.mu.Lock()
+			r.addrs[host] = addrs
+			r.mu.Unlock()
+		}
+		timer.Reset(next)
+	}
+}
+
+// resolve looks up the A and AAAA records of host on each server in turn.
+// The TTL returned is the lowest of the records, within bounds.
+func (r *bootstrapResolver) resolve(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	var errs []error
+	for _, server := range r.servers {
+		addrs, ttl, err := resolveOn(ctx, server, host)
+		if err == nil {
+			return addrs, ttl, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", server, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, 0, fmt.Errorf("bootstrap %s: %w", host, errors.Join(errs...))
+}
+
+// resolveOn looks up host on server. A query type that fails is skipped, a
+// server that can answer A but not AAAA, or the other way round, still
+// resolves the host.
+func resolveOn(ctx context.Context, server, host string) ([]netip.Addr, time.Duration, error) {
+	var addrs []netip.Addr
+	var errs []error
+	ttl := bootstrapMaxTTL
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(host), qtype)
+		c := &dns.Client{Timeout: bootstrapTimeout}
+		resp, _, err := c.ExchangeContext(ctx, req, server)
+		if err == nil && resp.Truncated {
+			c.Net = "tcp"
+			resp, _, err = c.ExchangeContext(ctx, req, server)
+		}
+		if err == nil && resp.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("got %s", dns.RcodeToString[resp.Rcode])
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", dns.TypeToString[qtype], err))
+			continue
+		}
+
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if addr, ok := netip.AddrFromSlice(ip); ok {
+				addrs = append(addrs, addr.Unmap())
+				ttl = min(ttl, time.Duration(rr.Header().Ttl)*time.Second)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if len(errs) > 0 {
+			return nil, 0, errors.Join(errs...)
+		}
+		return nil, 0, fmt.Errorf("no addresses")
+	}
+	return addrs, max(ttl, bootstrapMinTTL), nil
+}
+
+func (r *bootstrapResolver) Close() {
+	r.stop()
+}
+
+// staticResolver resolves every upstream host to pinned IPs.
+type staticResolver struct {
+	addrs []netip.Addr
+}
+
+var _ UP.Resolver = (*staticResolver)(nil)
+
+func (s *staticResolver) LookupNetIP(_ context.Context, _ string, _ string) ([]netip.Addr, error) {
+	return s.addrs, nil
+}
+
+// renamedResolver looks up host instead of the name it's asked for, which
+// is the TLS server name that took its place in the upstream url.
+type renamedResolver struct {
+	UP.Resolver
+	host string
+}
+
+func (r renamedResolver) LookupNetIP(ctx context.Context, network string, _ string) ([]netip.Addr, error) {
+	return r.Resolver.LookupNetIP(ctx, network, r.host)
+}
@@ -0,0 +1,86 @@
+package core
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testDNSServer serves handler on a local UDP port and returns its address.
+func testDNSServer(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &dns.Server{PacketConn: pc, Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestResolveOn(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, aaaa int // rcode, -1 doesn't answer
+		want    []string
+		ttl     time.Duration
+		wantErr bool
+	}{
+		{name: "both", a: dns.RcodeSuccess, aaaa: dns.RcodeSuccess, want: []string{"192.0.2.1", "2001:db8::1"}, ttl: 60 * time.Second},
+		{name: "aaaa fails", a: dns.RcodeSuccess, aaaa: dns.RcodeServerFailure, want: []string{"192.0.2.1"}, ttl: 60 * time.Second},
+		{name: "aaaa times out", a: dns.RcodeSuccess, aaaa: -1, want: []string{"192.0.2.1"}, ttl: 60 * time.Second},
+		{name: "a refused", a: dns.RcodeRefused, aaaa: dns.RcodeSuccess, want: []string{"2001:db8::1"}, ttl: 120 * time.Second},
+		{name: "both fail", a: dns.RcodeServerFailure, aaaa: dns.RcodeRefused, wantErr: true},
+		{name: "no records", a: dns.RcodeNameError, aaaa: dns.RcodeNameError, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := testDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+				resp := new(dns.Msg).SetReply(req)
+				rcode, rr := tt.a, "host.example. 60 IN A 192.0.2.1"
+				if req.Question[0].Qtype == dns.TypeAAAA {
+					rcode, rr = tt.aaaa, "host.example. 120 IN AAAA 2001:db8::1"
+				}
+				if rcode < 0 {
+					return
+				}
+				resp.Rcode = rcode
+				if rcode == dns.RcodeSuccess {
+					resp.Answer = append(resp.Answer, testRR(t, rr))
+				}
+				w.WriteMsg(resp)
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*bootstrapTimeout)
+			defer cancel()
+			addrs, ttl, err := resolveOn(ctx, server, "host.example")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveOn = %v, want an error", addrs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []netip.Addr
+			for _, s := range tt.want {
+				want = append(want, netip.MustParseAddr(s))
+			}
+			if !slices.Equal(addrs, want) {
+				t.Errorf("addrs = %v, want %v", addrs, want)
+			}
+			if ttl != max(tt.ttl, bootstrapMinTTL) {
+				t.Errorf("ttl = %s, want %s", ttl, max(tt.ttl, bootstrapMinTTL))
+			}
+		})
+	}
+}
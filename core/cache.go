@@ -0,0 +1,318 @@
+package core
+
+import (
+	"container/list"
+	"encoding/gob"
+	"errors"
+	"hash/maphash"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheShards is the most shards a cache is split in. Small caches get fewer,
+// so that every shard holds at least cacheShardMin entries and still works as
+// an LRU.
+const (
+	cacheShards   = 32
+	cacheShardMin = 8
+)
+
+// cache is a bounded, sharded LRU of upstream responses.
+//
+// Entries expire with the smallest TTL of the stored message, negative answers
+// (RFC 2308) use the SOA minimum instead.
+type cache struct {
+	seed        maphash.Seed
+	shards      []*cacheShard
+	negativeTTL uint32
+}
+
+type cacheShard struct {
+	mu    sync.Mutex
+	max   int
+	items map[string]*list.Element
+	lru   *list.List // front = most recently used
+}
+
+type cacheEntry struct {
+	key    string
+	msg    *dns.Msg
+	stored time.Time
+	expire time.Time
+}
+
+func newCache(size int, negativeTTL int) *cache {
+	c := &cache{
+		seed:        maphash.MakeSeed(),
+		negativeTTL: uint32(negativeTTL),
+	}
+
+	// the shard sizes add up to size exactly
+	n := min(max(size/cacheShardMin, 1), cacheShards)
+	c.shards = make([]*cacheShard, n)
+	for i := range c.shards {
+		perShard := size / n
+		if i < size%n {
+			perShard++
+		}
+		c.shards[i] = &cacheShard{
+			max:   max(perShard, 1),
+			items: make(map[string]*list.Element),
+			lru:   list.New(),
+		}
+	}
+	return c
+}
+
+// cacheKey builds the lookup key from the question, the DO/CD bits and the
+// client subnet sent upstream.
+func cacheKey(req *dns.Msg) (string, bool) {
+	if len(req.Question) != 1 {
+		return "", false
+	}
+	q := req.Question[0]
+
+	var b strings.Builder
+	b.WriteString(strings.ToLower(q.Name))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(int(q.Qtype)))
+	b.WriteByte('|')
+	b.WriteString(strconv.Itoa(int(q.Qclass)))
+	b.WriteByte('|')
+	if o := req.IsEdns0(); o != nil && o.Do() {
+		b.WriteByte('D')
+	}
+	if req.CheckingDisabled {
+		b.WriteByte('C')
+	}
+	b.WriteByte('|')
+	b.WriteString(ecsCacheKey(req))
+	return b.String(), true
+}
+
+func (c *cache) shard(key string) *cacheShard {
+	return c.shards[maphash.String(c.seed, key)%uint64(len(c.shards))]
+}
+
+// get returns a copy of the cached response with TTLs reduced by the time it
+// spent in the cache, or nil on miss.
+func (c *cache) get(key string, req *dns.Msg) *dns.Msg {
+	s := c.shard(key)
+	now := time.Now()
+
+	s.mu.Lock()
+	el, ok := s.items[key]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expire) {
+		s.lru.Remove(el)
+		delete(s.items, key)
+		s.mu.Unlock()
+		return nil
+	}
+	s.lru.MoveToFront(el)
+	resp := e.msg.Copy()
+	stored := e.stored
+	s.mu.Unlock()
+
+	age := uint32(now.Sub(stored) / time.Second)
+	forEachRR(resp, func(rr dns.RR) {
+		h := rr.Header()
+		if h.Ttl > age {
+			h.Ttl -= age
+		} else {
+			h.Ttl = 0
+		}
+	})
+
+	resp.Id = req.Id
+	resp.Question[0].Name = req.Question[0].Name
+	return resp
+}
+
+// set stores resp under key if it is cacheable.
+func (c *cache) set(key string, resp *dns.Msg) {
+	ttl, ok := c.ttl(resp)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.insert(&cacheEntry{
+		key:    key,
+		msg:    resp.Copy(),
+		stored: now,
+		expire: now.Add(time.Duration(ttl) * time.Second),
+	})
+}
+
+func (c *cache) insert(e *cacheEntry) {
+	key := e.key
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.items[key]; ok {
+		el.Value = e
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.items[key] = s.lru.PushFront(e)
+	for s.lru.Len() > s.max {
+		last := s.lru.Back()
+		s.lru.Remove(last)
+		delete(s.items, last.Value.(*cacheEntry).key)
+	}
+}
+
+// ttl returns how long resp may be cached.
+func (c *cache) ttl(resp *dns.Msg) (uint32, bool) {
+	if resp.Truncated || len(resp.Question) != 1 {
+		return 0, false
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		if len(resp.Answer) == 0 {
+			return c.negTTL(resp)
+		}
+	case dns.RcodeNameError:
+		return c.negTTL(resp)
+	default:
+		return 0, false
+	}
+
+	var lowest uint32
+	first := true
+	forEachRR(resp, func(rr dns.RR) {
+		if t := rr.Header().Ttl; first || t < lowest {
+			lowest = t
+			first = false
+		}
+	})
+	return lowest, !first
+}
+
+// negTTL implements RFC 2308 section 5: the negative TTL is the minimum of the
+// SOA record TTL and its MINIMUM field.
+func (c *cache) negTTL(resp *dns.Msg) (uint32, bool) {
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := min(soa.Hdr.Ttl, soa.Minttl)
+		if c.negativeTTL > 0 {
+			ttl = min(ttl, c.negativeTTL)
+		}
+		return ttl, true
+	}
+	return 0, false
+}
+
+func (c *cache) flush() {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		clear(s.items)
+		s.lru.Init()
+		s.mu.Unlock()
+	}
+}
+
+// snapshotEntry is the on-disk form of a cache entry.
+type snapshotEntry struct {
+	Key    string
+	Msg    []byte
+	Stored time.Time
+	Expire time.Time
+}
+
+// save writes the unexpired entries to path, replacing it atomically.
+func (c *cache) save(path string) error {
+	now := time.Now()
+	var entries []snapshotEntry
+	for _, s := range c.shards {
+		s.mu.Lock()
+		// oldest first, so loading restores the LRU order
+		for el := s.lru.Back(); el != nil; el = el.Prev() {
+			e := el.Value.(*cacheEntry)
+			if !now.Before(e.expire) {
+				continue
+			}
+			msg, err := e.msg.Pack()
+			if err != nil {
+				continue
+			}
+			entries = append(entries, snapshotEntry{Key: e.key, Msg: msg, Stored: e.stored, Expire: e.expire})
+		}
+		s.mu.Unlock()
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(entries); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// load restores a snapshot written by save. A missing file is not an error.
+func (c *cache) load(path string) (int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var entries []snapshotEntry
+	if err := gob.NewDecoder(f).Decode(&entries); err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	n := 0
+	for _, se := range entries {
+		if !now.Before(se.Expire) {
+			continue
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(se.Msg); err != nil {
+			continue
+		}
+		c.insert(&cacheEntry{key: se.Key, msg: msg, stored: se.Stored, expire: se.Expire})
+		n++
+	}
+	return n, nil
+}
+
+// forEachRR calls fn on every record of msg except OPT.
+func forEachRR(msg *dns.Msg, fn func(rr dns.RR)) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			fn(rr)
+		}
+	}
+}
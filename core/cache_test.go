@@ -0,0 +1,238 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func testAnswer(t *testing.T, name string, rcode int, answer, ns []string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(name, dns.TypeA)
+	m.Response = true
+	m.Rcode = rcode
+	for _, s := range answer {
+		m.Answer = append(m.Answer, testRR(t, s))
+	}
+	for _, s := range ns {
+		m.Ns = append(m.Ns, testRR(t, s))
+	}
+	return m
+}
+
+func TestCacheTTL(t *testing.T) {
+	const soa = "example. 3600 IN SOA ns.example. host.example. 1 7200 900 1209600 300"
+	tests := []struct {
+		name        string
+		negativeTTL int
+		msg         func() *dns.Msg
+		want        uint32
+		wantOK      bool
+	}{{
+		name: "lowest record ttl",
+		msg: func() *dns.Msg {
+			return testAnswer(t, "www.example.", dns.RcodeSuccess,
+				[]string{"www.example. 300 IN CNAME a.example.", "a.example. 60 IN A 192.0.2.1"}, nil)
+		},
+		want: 60, wantOK: true,
+	}, {
+		name: "nxdomain uses the soa minimum",
+		msg: func() *dns.Msg {
+			return testAnswer(t, "missing.example.", dns.RcodeNameError, nil, []string{soa})
+		},
+		want: 300, wantOK: true,
+	}, {
+		name: "nodata uses the soa ttl if lower",
+		msg: func() *dns.Msg {
+			return testAnswer(t, "www.example.", dns.RcodeSuccess, nil,
+				[]string{"example. 120 IN SOA ns.example. host.example. 1 7200 900 1209600 300"})
+		},
+		want: 120, wantOK: true,
+	}, {
+		name:        "negative ttl cap",
+		negativeTTL: 30,
+		msg: func() *dns.Msg {
+			return testAnswer(t, "missing.example.", dns.RcodeNameError, nil, []string{soa})
+		},
+		want: 30, wantOK: true,
+	}, {
+		name: "negative answer without soa",
+		msg: func() *dns.Msg {
+			return testAnswer(t, "missing.example.", dns.RcodeNameError, nil, nil)
+		},
+	}, {
+		name: "servfail",
+		msg: func() *dns.Msg {
+			return testAnswer(t, "www.example.", dns.RcodeServerFailure, nil, nil)
+		},
+	}, {
+		name: "truncated",
+		msg: func() *dns.Msg {
+			m := testAnswer(t, "www.example.", dns.RcodeSuccess, []string{"www.example. 300 IN A 192.0.2.1"}, nil)
+			m.Truncated = true
+			return m
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCache(16, tt.negativeTTL)
+			got, ok := c.ttl(tt.msg())
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("ttl = %d, %t, want %d, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCacheGetSet(t *testing.T) {
+	c := newCache(16, 0)
+	resp := testAnswer(t, "www.example.", dns.RcodeSuccess, []string{"www.example. 300 IN A 192.0.2.1"}, nil)
+	key, _ := cacheKey(resp)
+
+	req := new(dns.Msg)
+	req.SetQuestion("WWW.Example.", dns.TypeA)
+	if got := c.get(key, req); got != nil {
+		t.Fatalf("get before set = %v", got)
+	}
+
+	c.set(key, resp)
+	got := c.get(key, req)
+	if got == nil {
+		t.Fatal("get after set missed")
+	}
+	if got.Id != req.Id || got.Question[0].Name != "WWW.Example." {
+		t.Errorf("answer not matched to the request: id %d, name %s", got.Id, got.Question[0].Name)
+	}
+
+	// the cached copy is not shared with the caller
+	got.Answer[0].Header().Ttl = 1
+	if again := c.get(key, req); again.Answer[0].Header().Ttl != 300 {
+		t.Errorf("cached ttl changed to %d through a returned copy", again.Answer[0].Header().Ttl)
+	}
+
+	zero := testAnswer(t, "zero.example.", dns.RcodeSuccess, []string{"zero.example. 0 IN A 192.0.2.1"}, nil)
+	zkey, _ := cacheKey(zero)
+	c.set(zkey, zero)
+	if got := c.get(zkey, zero); got != nil {
+		t.Error("answer with ttl 0 was cached")
+	}
+}
+
+func TestCacheAging(t *testing.T) {
+	resp := testAnswer(t, "www.example.", dns.RcodeSuccess,
+		[]string{"www.example. 300 IN CNAME a.example.", "a.example. 60 IN A 192.0.2.1"}, nil)
+	key, _ := cacheKey(resp)
+	tests := []struct {
+		name  string
+		age   time.Duration
+		ttl   time.Duration
+		want  []uint32
+		empty bool
+	}{
+		{name: "fresh", ttl: time.Minute, want: []uint32{300, 60}},
+		{name: "aged", age: 50 * time.Second, ttl: 10 * time.Second, want: []uint32{250, 10}},
+		{name: "ttls don't go below zero", age: 100 * time.Second, ttl: time.Second, want: []uint32{200, 0}},
+		{name: "expired", age: 61 * time.Second, ttl: -time.Second, empty: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCache(16, 0)
+			now := time.Now()
+			c.insert(&cacheEntry{key: key, msg: resp.Copy(), stored: now.Add(-tt.age), expire: now.Add(tt.ttl)})
+
+			got := c.get(key, resp)
+			if tt.empty {
+				if got != nil {
+					t.Fatalf("got an expired entry")
+				}
+				if n := c.shard(key).lru.Len(); n != 0 {
+					t.Errorf("expired entry still stored, %d entries", n)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("miss")
+			}
+			for i, rr := range got.Answer {
+				if rr.Header().Ttl != tt.want[i] {
+					t.Errorf("%s ttl = %d, want %d", rr.Header().Name, rr.Header().Ttl, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newCache(8, 0)
+	if len(c.shards) != 1 {
+		t.Fatalf("8 entries split in %d shards", len(c.shards))
+	}
+	keys := make([]string, 9)
+	for i := range keys {
+		name := fmt.Sprintf("host%d.example.", i)
+		resp := testAnswer(t, name, dns.RcodeSuccess, []string{name + " 300 IN A 192.0.2.1"}, nil)
+		keys[i], _ = cacheKey(resp)
+		c.set(keys[i], resp)
+		if i == 7 {
+			// host0 becomes the most recently used
+			if c.get(keys[0], resp) == nil {
+				t.Fatal("host0 evicted early")
+			}
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("x.", dns.TypeA)
+	if c.get(keys[1], req) != nil {
+		t.Error("least recently used entry kept")
+	}
+	for _, i := range []int{0, 2, 8} {
+		if c.get(keys[i], req) == nil {
+			t.Errorf("host%d evicted", i)
+		}
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	tests := []struct {
+		size   int
+		shards int
+	}{
+		{1, 1},
+		{7, 1},
+		{16, 2},
+		{100, 12},
+		{4096, cacheShards},
+	}
+	for _, tt := range tests {
+		c := newCache(tt.size, 0)
+		if len(c.shards) != tt.shards {
+			t.Errorf("size %d: %d shards, want %d", tt.size, len(c.shards), tt.shards)
+		}
+		total := 0
+		for _, s := range c.shards {
+			if s.max < min(tt.size, cacheShardMin) {
+				t.Errorf("size %d: shard of %d entries", tt.size, s.max)
+			}
+			total += s.max
+		}
+		if total != tt.size {
+			t.Errorf("size %d: shards hold %d entries", tt.size, total)
+		}
+
+		// a single shard keeps exactly size entries, more shards at most that
+		for i := range 2 * tt.size {
+			c.insert(&cacheEntry{key: fmt.Sprint(i), msg: new(dns.Msg), expire: time.Now().Add(time.Minute)})
+		}
+		stored := 0
+		for _, s := range c.shards {
+			stored += s.lru.Len()
+		}
+		if stored > tt.size || (tt.shards == 1 && stored != tt.size) {
+			t.Errorf("size %d: %d entries stored", tt.size, stored)
+		}
+	}
+}
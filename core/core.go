@@ -2,79 +2,391 @@ package core
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
 	"net/netip"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"time"
 
 	"df/conf"
+	"df/metrics"
 
-	UP "github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/miekg/dns"
 )
 
-var (
-	upstreamClients []UP.Upstream
-	onceInit        = false
+// state is everything Core needs that is built from the config. Reload
+// builds a new one and swaps it in, queries already running keep the state
+// they started with.
+type state struct {
+	cfg    *conf.Config
+	groups []*upstreamGroup // the default group first
+	router *router
+	ttl    conf.TTLOptions
+	cache  *cache
+	block  atomic.Pointer[blocker]
+	hosts  atomic.Pointer[localZone]
+	users  map[string]*userPolicy
+	subnet *subnet
+	qlog   *queryLog  // nil if disabled
+	dnssec *validator // nil unless validating
+	dns64  *dns64     // nil if disabled
+
+	stopWatch context.CancelFunc // stops the rule set watchers
+	inflight  atomic.Int64
+}
+
+var current atomic.Pointer[state]
+
+// retireGrace is how long a replaced state may still be picked up by a query
+// that loaded it right before the swap; retireTimeout bounds the wait for
+// queries still running on it.
+const (
+	retireGrace   = time.Second
+	retireTimeout = 30 * time.Second
 )
 
 func Init() {
-	if onceInit {
+	if current.Load() != nil {
+		return
+	}
+
+	st, err := newState(conf.Info(), nil)
+	if err != nil {
+		slog.Error("init core", "err", err)
+		os.Exit(1)
+	}
+	current.Store(st)
+
+	if path := conf.Info().Options.Cache.Snapshot; path != "" && st.cache != nil {
+		n, err := st.cache.load(path)
+		if err != nil {
+			slog.Warn("load cache snapshot", "path", path, "err", err)
+		} else {
+			slog.Info("cache snapshot restored", "path", path, "entries", n)
+		}
+	}
+}
+
+// Close stops the core: rule set watchers end, the cache is saved if a
+// snapshot file is configured and the upstream connections are closed. Core
+// must not be called afterwards.
+func Close() {
+	st := current.Load()
+	if st == nil {
 		return
 	}
+	st.stopWatch()
 
-	cfg := conf.Info()
+	if path := st.cfg.Options.Cache.Snapshot; path != "" && st.cache != nil {
+		if err := st.cache.save(path); err != nil {
+			slog.Error("save cache snapshot", "path", path, "err", err)
+		} else {
+			slog.Info("cache snapshot saved", "path", path)
+		}
+	}
 
-	opts := &UP.Options{
-		HTTPVersions: []UP.HTTPVersion{
-			UP.HTTPVersion3,
-			UP.HTTPVersion2,
-			UP.HTTPVersion11,
-		},
+	st.closeUpstreams(nil)
+	if st.qlog != nil {
+		st.qlog.close()
 	}
+}
 
-	bootstrapIP, err := netip.ParseAddr(cfg.Options.Bootstrap)
+// Reload rebuilds the core from cfg. On error the old state keeps serving.
+func Reload(cfg *conf.Config) error {
+	old := current.Load()
+	st, err := newState(cfg, old)
 	if err != nil {
-		log.Fatalf("[fatal] invalid bootstrap IP: %v", err)
+		return err
+	}
+	current.Store(st)
+	go retire(old, st)
+	return nil
+}
+
+func newState(cfg *conf.Config, old *state) (*state, error) {
+	st := &state{
+		cfg:    cfg,
+		ttl:    cfg.Options.TTL,
+		subnet: newSubnet(cfg.Options.EDNS0Subnet),
+		dns64:  newDNS64(cfg.Options.DNS64),
 	}
 
-	opts.Bootstrap = &singleIPResolver{ip: bootstrapIP}
+	groups, err := upstreamGroups(cfg, old)
+	if err != nil {
+		return nil, err
+	}
+	st.groups = groups
+	st.router = newRouter(cfg.Routes, groups)
 
-	// build all upstreams
-	for _, addr := range cfg.Upstream {
-		up, err := UP.AddressToUpstream(addr, opts)
+	if old != nil && old.cfg.Options.DNSSEC == cfg.Options.DNSSEC {
+		st.dnssec = old.dnssec
+	} else if cfg.Options.DNSSEC.Validate {
+		st.dnssec, err = newValidator(cfg.Options.DNSSEC)
 		if err != nil {
-			log.Fatalf("[fatal] invalid upstream %s: %v", addr, err)
+			st.closeUpstreams(old)
+			return nil, fmt.Errorf("invalid dnssec config: %w", err)
 		}
-		upstreamClients = append(upstreamClients, up)
 	}
 
-	onceInit = true
-}
+	// cached answers are only kept while they'd still be answered the same
+	if old != nil && old.cfg.Options.Cache == cfg.Options.Cache && sameAnswers(old.cfg, cfg) {
+		st.cache = old.cache
+	} else if !cfg.Options.Cache.Disable {
+		st.cache = newCache(cfg.Options.Cache.Size, cfg.Options.Cache.NegativeTTL)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	st.stopWatch = cancel
 
-func Core(req *dns.Msg) (*dns.Msg, error) {
-	if upstreamClients == nil {
-		log.Fatalf("[fatal] upstream not initialized")
+	bl, err := newBlocker("", cfg.Block)
+	if err != nil {
+		cancel()
+		st.closeUpstreams(old)
+		return nil, fmt.Errorf("invalid block config: %w", err)
 	}
-	// TODO: Block
+	st.block.Store(bl)
+	go watchRuleSets(ctx, "", cfg.Block, &st.block)
 
-	// TODO: Subnet
+	z, err := newLocalZone(cfg.Hosts)
+	if err != nil {
+		cancel()
+		st.closeUpstreams(old)
+		return nil, fmt.Errorf("invalid hosts config: %w", err)
+	}
+	st.hosts.Store(z)
+	go watchHosts(ctx, cfg.Hosts, &st.hosts)
 
-	resp, fastestUp, err := UP.ExchangeParallel(upstreamClients, req)
+	st.users, err = newUserPolicies(ctx, cfg.Server.Doh.Auth)
 	if err != nil {
+		cancel()
+		st.closeUpstreams(old)
 		return nil, err
 	}
-	// TODO: fastesUp
-	_ = fastestUp
 
-	// TODO: TTL
-	return resp, nil
+	if old != nil && old.cfg.QueryLog == cfg.QueryLog {
+		st.qlog = old.qlog
+	} else if cfg.QueryLog.Dir != "" {
+		st.qlog, err = newQueryLog(cfg.QueryLog)
+		if err != nil {
+			cancel()
+			st.closeUpstreams(old)
+			return nil, err
+		}
+	}
+
+	return st, nil
+}
+
+// sameAnswers reports whether a and b shape the answers of the upstreams
+// the same way.
+func sameAnswers(a, b *conf.Config) bool {
+	return reflect.DeepEqual(a.Upstream, b.Upstream) &&
+		reflect.DeepEqual(a.UpstreamGroups, b.UpstreamGroups) &&
+		reflect.DeepEqual(a.Routes, b.Routes) &&
+		reflect.DeepEqual(a.Options.TTL, b.Options.TTL) &&
+		reflect.DeepEqual(a.Options.EDNS0Subnet, b.Options.EDNS0Subnet) &&
+		reflect.DeepEqual(a.Options.DNSSEC, b.Options.DNSSEC)
+}
+
+// closeUpstreams closes the upstreams of st unless other reuses them.
+func (st *state) closeUpstreams(other *state) {
+	closeGroups(st.groups, other)
+}
+
+// retire shuts old down once the queries running on it are done.
+func retire(old, next *state) {
+	old.stopWatch()
+
+	time.Sleep(retireGrace)
+	deadline := time.Now().Add(retireTimeout)
+	for old.inflight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	old.closeUpstreams(next)
+	if old.qlog != nil && old.qlog != next.qlog {
+		old.qlog.close()
+	}
+}
+
+// Client describes where a query came from.
+type Client struct {
+	Addr netip.Addr // zero if the listener can't tell
+	User string     // authenticated DoH user
+	// Proto is the listener protocol: udp, tcp, dot, doq, doh2, doh3 or http.
+	Proto string
+}
+
+// Core resolves req on behalf of client.
+func Core(req *dns.Msg, client Client) (*dns.Msg, error) {
+	st := current.Load()
+	if st == nil {
+		panic("core: Init has not been called")
+	}
+	st.inflight.Add(1)
+	defer st.inflight.Add(-1)
+
+	start := time.Now()
+	e := QueryEvent{Time: start, User: client.User, Proto: client.Proto}
+	if client.Addr.IsValid() {
+		e.Client = client.Addr.String()
+	}
+	if len(req.Question) == 1 {
+		e.Name = req.Question[0].Name
+		e.Type = dns.Type(req.Question[0].Qtype).String()
+	}
+
+	resp, err := st.resolve(req, client, &e)
+
+	e.Latency = time.Since(start)
+	if err != nil {
+		e.Error = err.Error()
+		e.Rcode = dns.RcodeToString[dns.RcodeServerFailure]
+	} else {
+		e.Rcode = dns.RcodeToString[resp.Rcode]
+	}
+	stats.record(e)
+	if st.qlog != nil {
+		st.qlog.record(e)
+	}
+	observeQuery(req, resp, err, &e)
+
+	return resp, err
 }
 
-type singleIPResolver struct {
-	ip netip.Addr
+func observeQuery(req, resp *dns.Msg, err error, e *QueryEvent) {
+	proto, qtype, rcode := e.Proto, "other", metrics.Rcode(dns.RcodeServerFailure)
+	if proto == "" {
+		proto = "unknown"
+	}
+	if len(req.Question) == 1 {
+		qtype = metrics.QType(req.Question[0].Qtype)
+	}
+	if err == nil {
+		rcode = metrics.Rcode(resp.Rcode)
+	}
+	metrics.Queries.WithLabelValues(proto, qtype, rcode).Inc()
+
+	if e.Blocked {
+		metrics.Blocked.WithLabelValues(e.BlockedBy).Inc()
+	}
+	if e.Upstream != "" {
+		metrics.Answered.WithLabelValues(e.Upstream).Inc()
+	}
 }
 
-var _ UP.Resolver = (*singleIPResolver)(nil)
+// resolve does the actual work of Core and fills in how the answer was
+// obtained.
+func (st *state) resolve(req *dns.Msg, client Client, e *QueryEvent) (*dns.Msg, error) {
+	if len(req.Question) == 1 {
+		bl := st.block.Load()
+		if src, ok := bl.match(req.Question[0].Name, client.Addr); ok {
+			e.Blocked, e.BlockedBy = true, src
+			return bl.reply(req), nil
+		}
+	}
+	if p, ok := st.users[client.User]; ok {
+		if resp, src := p.check(req, client); resp != nil {
+			e.Blocked, e.BlockedBy = src != "", src
+			return resp, nil
+		}
+	}
+
+	if st.dns64 != nil && st.dns64.applies(req, client.Addr) {
+		return st.dns64.resolve(st, req, client, e)
+	}
+	return st.answer(req, client, e)
+}
 
-func (s *singleIPResolver) LookupNetIP(_ context.Context, _ string, _ string) (addrs []netip.Addr, err error) {
-	return []netip.Addr{s.ip}, nil
+// answer resolves req from the local names or through forward.
+func (st *state) answer(req *dns.Msg, client Client, e *QueryEvent) (*dns.Msg, error) {
+	if len(req.Question) == 1 {
+		if z := st.hosts.Load(); !z.empty() {
+			if resp, chase := z.answer(req); resp != nil {
+				e.Local = true
+				if chase == "" {
+					return resp, nil
+				}
+				// the local CNAME chain ends at a name only upstream knows
+				sub := req.Copy()
+				sub.Question[0].Name = chase
+				ext, err := st.forward(sub, client, e)
+				if err != nil {
+					return nil, err
+				}
+				resp.Rcode = ext.Rcode
+				resp.Answer = append(resp.Answer, ext.Answer...)
+				return resp, nil
+			}
+		}
+	}
+	return st.forward(req, client, e)
+}
+
+// forward answers req from the cache or the upstreams.
+func (st *state) forward(req *dns.Msg, client Client, e *QueryEvent) (*dns.Msg, error) {
+	out := st.subnet.apply(req, client.Addr)
+
+	key, cacheable := "", false
+	if st.cache != nil {
+		key, cacheable = cacheKey(out)
+	}
+	if cacheable {
+		if resp := st.cache.get(key, req); resp != nil {
+			metrics.Cache.WithLabelValues("hit").Inc()
+			e.Cached = true
+			st.subnet.restore(req, resp)
+			return resp, nil
+		}
+		metrics.Cache.WithLabelValues("miss").Inc()
+	}
+
+	g := st.router.fallback
+	if len(req.Question) == 1 {
+		g = st.router.route(req.Question[0].Name)
+	}
+	validate := st.dnssec != nil && !req.CheckingDisabled && len(req.Question) == 1
+	send := out
+	if validate {
+		// CD so the upstreams hand over bogus data too, we judge it
+		send = out.Copy()
+		if opt := send.IsEdns0(); opt != nil {
+			opt.SetDo()
+		} else {
+			send.SetEdns0(dnssecUDPSize, true)
+		}
+		send.CheckingDisabled = true
+	}
+	resp, up, err := g.policy.exchange(g.upstreams, send)
+	if err != nil {
+		return nil, err
+	}
+	e.Upstream = up.label
+
+	if validate {
+		sec, err := st.dnssec.validate(resp, st.dnssecLookup)
+		if sec == bogus {
+			slog.Debug("dnssec validation failed", "name", req.Question[0].Name, "err", err)
+			e.Error = fmt.Sprintf("dnssec: %v", err)
+			return bogusReply(req, err), nil
+		}
+		resp.AuthenticatedData = sec == secure
+		resp.CheckingDisabled = false
+		if o := req.IsEdns0(); o == nil || !o.Do() {
+			stripDNSSEC(resp, req.Question[0].Qtype)
+			if o := resp.IsEdns0(); o != nil {
+				o.SetDo(false)
+			}
+		}
+	}
+
+	// clamp before caching so the cache honors the rewritten TTLs
+	rewriteTTL(resp, st.ttl)
+	if cacheable {
+		st.cache.set(key, resp)
+	}
+	st.subnet.restore(req, resp)
+
+	return resp, nil
 }
@@ -0,0 +1,253 @@
+package core
+
+import (
+	"net/netip"
+	"strings"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+// dns64NegTTL caps the TTL of synthesized records when the empty AAAA answer
+// came without an SOA (RFC 6147 section 5.1.7).
+const dns64NegTTL = 600
+
+// dns64 synthesizes AAAA records from A records and answers the matching
+// reverse queries, see conf.DNS64Options.
+type dns64 struct {
+	prefix   netip.Prefix
+	exclude6 []netip.Prefix
+	exclude4 []netip.Prefix
+	clients  []netip.Prefix
+}
+
+func newDNS64(cfg conf.DNS64Options) *dns64 {
+	if !cfg.Enable {
+		return nil
+	}
+	d := &dns64{prefix: cfg.NAT64, clients: cfg.ClientPrefixes}
+	for _, p := range cfg.ExcludePrefixes {
+		if p.Addr().Is4() {
+			d.exclude4 = append(d.exclude4, p)
+		} else {
+			d.exclude6 = append(d.exclude6, p)
+		}
+	}
+	return d
+}
+
+// applies reports whether req from client is one DNS64 answers.
+func (d *dns64) applies(req *dns.Msg, client netip.Addr) bool {
+	if len(req.Question) != 1 || req.Question[0].Qclass != dns.ClassINET {
+		return false
+	}
+	if t := req.Question[0].Qtype; t != dns.TypeAAAA && t != dns.TypePTR {
+		return false
+	}
+	// a validating client wants the real records (RFC 6147 section 5.5)
+	if o := req.IsEdns0(); o != nil && o.Do() && req.CheckingDisabled {
+		return false
+	}
+	if len(d.clients) == 0 {
+		return true
+	}
+	client = client.Unmap()
+	for _, p := range d.clients {
+		if p.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve answers an AAAA or PTR query from the local names or the
+// upstreams, synthesizing where the real records are missing.
+func (d *dns64) resolve(st *state, req *dns.Msg, client Client, e *QueryEvent) (*dns.Msg, error) {
+	q := req.Question[0]
+	if q.Qtype == dns.TypePTR {
+		return d.resolvePTR(st, req, client, e)
+	}
+
+	resp, err := st.answer(req, client, e)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return resp, nil
+	}
+
+	// real AAAA records win, minus the excluded ones
+	var kept []dns.RR
+	found := false
+	for _, rr := range resp.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok {
+			addr, _ := netip.AddrFromSlice(aaaa.AAAA)
+			if excluded(d.exclude6, addr) {
+				continue
+			}
+			found = true
+		}
+		kept = append(kept, rr)
+	}
+	resp.Answer = kept
+	if found && resp.Rcode == dns.RcodeSuccess {
+		return resp, nil
+	}
+
+	sub := req.Copy()
+	sub.Question[0].Qtype = dns.TypeA
+	a, err := st.answer(sub, client, e)
+	if err != nil || a.Rcode != dns.RcodeSuccess {
+		return resp, nil
+	}
+
+	negTTL := uint32(dns64NegTTL)
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			negTTL = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	var answer []dns.RR
+	synthesized := false
+	for _, rr := range a.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ := netip.AddrFromSlice(rr.A)
+			addr = addr.Unmap()
+			if excluded(d.exclude4, addr) {
+				continue
+			}
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			hdr.Ttl = min(hdr.Ttl, negTTL)
+			answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: d.embed(addr).AsSlice()})
+			synthesized = true
+		case *dns.CNAME, *dns.DNAME:
+			answer = append(answer, rr)
+		}
+	}
+	if !synthesized {
+		return resp, nil
+	}
+
+	out := resp.Copy()
+	out.Rcode = dns.RcodeSuccess
+	out.Answer = answer
+	out.Ns = nil
+	// made up by us, nothing the upstreams vouched for
+	out.AuthenticatedData = false
+	return out, nil
+}
+
+// resolvePTR answers a reverse query for an address in the prefix with the
+// PTR records of the embedded IPv4 address.
+func (d *dns64) resolvePTR(st *state, req *dns.Msg, client Client, e *QueryEvent) (*dns.Msg, error) {
+	name := req.Question[0].Name
+	addr, ok := parseReverse6(name)
+	if !ok || !d.prefix.Contains(addr) {
+		return st.answer(req, client, e)
+	}
+	rev, err := dns.ReverseAddr(d.extract(addr).String())
+	if err != nil {
+		return st.answer(req, client, e)
+	}
+
+	sub := req.Copy()
+	sub.Question[0].Name = rev
+	resp, err := st.answer(sub, client, e)
+	if err != nil {
+		return nil, err
+	}
+	out := resp.Copy()
+	out.Question = req.Question
+	out.AuthenticatedData = false
+	var answer []dns.RR
+	for _, rr := range out.Answer {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			continue
+		}
+		if strings.EqualFold(rr.Header().Name, rev) {
+			rr.Header().Name = name
+		}
+		answer = append(answer, rr)
+	}
+	out.Answer = answer
+	return out, nil
+}
+
+// embed places v4 in the prefix as RFC 6052 section 2.2 describes, skipping
+// the reserved bits 64 to 71.
+func (d *dns64) embed(v4 netip.Addr) netip.Addr {
+	b := d.prefix.Addr().As16()
+	ip := v4.As4()
+	for i, j := d.prefix.Bits()/8, 0; j < len(ip); i++ {
+		if i == 8 {
+			continue
+		}
+		b[i] = ip[j]
+		j++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// extract is the reverse of embed.
+func (d *dns64) extract(v6 netip.Addr) netip.Addr {
+	b := v6.As16()
+	var ip [4]byte
+	for i, j := d.prefix.Bits()/8, 0; j < len(ip); i++ {
+		if i == 8 {
+			continue
+		}
+		ip[j] = b[i]
+		j++
+	}
+	return netip.AddrFrom4(ip)
+}
+
+func excluded(ranges []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range ranges {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReverse6 turns a full ip6.arpa name back into its address.
+func parseReverse6(name string) (netip.Addr, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	nibbles, ok := strings.CutSuffix(name, ".ip6.arpa")
+	if !ok {
+		return netip.Addr{}, false
+	}
+	labels := strings.Split(nibbles, ".")
+	if len(labels) != 32 {
+		return netip.Addr{}, false
+	}
+
+	var b [16]byte
+	for i, l := range labels {
+		if len(l) != 1 {
+			return netip.Addr{}, false
+		}
+		var v byte
+		switch c := l[0]; {
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		default:
+			return netip.Addr{}, false
+		}
+		// the first label is the lowest nibble
+		pos := 31 - i
+		if pos%2 == 0 {
+			b[pos/2] |= v << 4
+		} else {
+			b[pos/2] |= v
+		}
+	}
+	return netip.AddrFrom16(b), true
+}
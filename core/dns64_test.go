@@ -0,0 +1,72 @@
+package core
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEmbedExtract(t *testing.T) {
+	// RFC 6052 section 2.4
+	v4 := netip.MustParseAddr("192.0.2.33")
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+		{"64:ff9b::/96", "64:ff9b::c000:221"},
+	}
+	for _, tt := range tests {
+		d := &dns64{prefix: netip.MustParsePrefix(tt.prefix)}
+		got := d.embed(v4)
+		if want := netip.MustParseAddr(tt.want); got != want {
+			t.Errorf("embed(%s) in %s = %s, want %s", v4, tt.prefix, got, want)
+		}
+		if back := d.extract(got); back != v4 {
+			t.Errorf("extract(%s) in %s = %s, want %s", got, tt.prefix, back, v4)
+		}
+	}
+}
+
+func TestParseReverse6(t *testing.T) {
+	const name = "b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa."
+	synth, err := dns.ReverseAddr("64:ff9b::c000:221")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{name, "4321:0:1:2:3:4:567:89ab", true},
+		{strings.TrimSuffix(name, "."), "4321:0:1:2:3:4:567:89ab", true},
+		{strings.ToUpper(name), "4321:0:1:2:3:4:567:89ab", true},
+		{synth, "64:ff9b::c000:221", true},
+		// partial names are zones, not addresses
+		{synth[8:], "", false},
+		{"1." + name, "", false},
+		{strings.Replace(name, "b.a", "ba", 1), "", false},
+		{strings.Replace(name, "b.a", "g.a", 1), "", false},
+		{strings.Replace(name, "ip6.arpa", "in-addr.arpa", 1), "", false},
+		{"33.2.0.192.in-addr.arpa.", "", false},
+		{"ip6.arpa.", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := parseReverse6(tt.name)
+		if ok != tt.wantOK {
+			t.Errorf("parseReverse6(%q) ok = %t, want %t", tt.name, ok, tt.wantOK)
+			continue
+		}
+		if ok && got != netip.MustParseAddr(tt.want) {
+			t.Errorf("parseReverse6(%q) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
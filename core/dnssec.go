@@ -0,0 +1,796 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnssecMinTTL and dnssecMaxTTL bound how long the validated keys and
+	// delegations are kept.
+	dnssecMinTTL = time.Minute
+	dnssecMaxTTL = time.Hour
+	// dnssecCacheMax is the number of names the validator remembers before
+	// starting over.
+	dnssecCacheMax = 16384
+	dnssecUDPSize  = 1232
+)
+
+// security is the DNSSEC status of an answer, the parts of an answer add up
+// to the worst of theirs.
+type security int
+
+const (
+	secure   security = iota
+	insecure          // no chain of trust reaches the data
+	bogus
+)
+
+// supportedAlgorithms are the DNSKEY algorithms we can verify, zones signed
+// with others are treated as unsigned (RFC 4035 section 5.2).
+var supportedAlgorithms = map[uint8]bool{
+	dns.RSASHA1:          true,
+	dns.RSASHA1NSEC3SHA1: true,
+	dns.RSASHA256:        true,
+	dns.RSASHA512:        true,
+	dns.ECDSAP256SHA256:  true,
+	dns.ECDSAP384SHA384:  true,
+	dns.ED25519:          true,
+}
+
+var supportedDigests = map[uint8]bool{
+	dns.SHA1:   true,
+	dns.SHA256: true,
+	dns.SHA384: true,
+}
+
+// lookupFunc fetches the records the validator needs from the upstreams,
+// with DO and CD set.
+type lookupFunc func(name string, qtype uint16) (*dns.Msg, error)
+
+// validator checks upstream answers against the chain of trust from the
+// root trust anchor. The keys and delegations it validated on the way are
+// cached for their TTL.
+type validator struct {
+	anchors []dns.RR // root DS or DNSKEY records
+
+	mu    sync.Mutex
+	zones map[string]zoneEntry
+}
+
+// zoneEntry is what the chain of trust says about a name: it starts a
+// secure zone with keys, it is an insecure delegation, or it belongs to the
+// zone above it.
+type zoneEntry struct {
+	status security
+	cut    bool
+	keys   []*dns.DNSKEY
+	expire time.Time
+}
+
+func newValidator(cfg conf.DNSSECOptions) (*validator, error) {
+	path, err := conf.FilePath(cfg.TrustAnchor)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	v := &validator{zones: make(map[string]zoneEntry)}
+	zp := dns.NewZoneParser(f, ".", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			continue
+		}
+		if rr.Header().Name != "." {
+			return nil, fmt.Errorf("trust anchor %s: only root anchors are supported, got %s", path, rr.Header().Name)
+		}
+		v.anchors = append(v.anchors, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("trust anchor %s: %w", path, err)
+	}
+	if len(v.anchors) == 0 {
+		return nil, fmt.Errorf("trust anchor %s: no DS or DNSKEY records", path)
+	}
+	return v, nil
+}
+
+// validate returns the security status of resp, an upstream answer to a
+// query with DO set. Bogus comes with the reason.
+func (v *validator) validate(resp *dns.Msg, lookup lookupFunc) (security, error) {
+	if len(resp.Question) != 1 || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return insecure, nil
+	}
+	q := resp.Question[0]
+
+	status := secure
+	merge := func(s security) {
+		status = max(status, s)
+	}
+
+	// every answer RRset must be signed by the zone it lives in, and only the
+	// ones owned by the end of the CNAME chain answer the question
+	sname := dns.Fqdn(strings.ToLower(q.Name))
+	answered := false
+	for _, set := range rrsets(resp.Answer) {
+		h := set.rrs[0].Header()
+		switch {
+		case !strings.EqualFold(h.Name, sname):
+		case h.Rrtype == q.Qtype || q.Qtype == dns.TypeANY:
+			answered = true
+		case h.Rrtype == dns.TypeCNAME:
+			sname = dns.Fqdn(strings.ToLower(set.rrs[0].(*dns.CNAME).Target))
+		}
+		s, err := v.checkRRset(set, resp.Ns, lookup)
+		if s == bogus {
+			return bogus, err
+		}
+		merge(s)
+	}
+	if answered && resp.Rcode == dns.RcodeSuccess {
+		return status, nil
+	}
+
+	// denial of existence, for the name the CNAME chain ended at, signed by
+	// the zone the authority records name
+	zoneName := sname
+	if q.Qtype == dns.TypeDS {
+		zoneName = parentName(sname)
+	}
+	zone := ""
+	for _, set := range rrsets(resp.Ns) {
+		if zone = signerOf(set); zone != "" {
+			break
+		}
+	}
+	var keys []*dns.DNSKEY
+	var s security
+	var err error
+	switch {
+	case zone == "":
+		zone, keys, s, err = v.zoneOf(zoneName, lookup)
+	case !dns.IsSubDomain(zone, zoneName):
+		return bogus, fmt.Errorf("denial for %s signed by %s", sname, zone)
+	default:
+		keys, s, err = v.signerKeys(zone, lookup)
+	}
+	if s != secure {
+		return max(status, s), err
+	}
+	var nsec, nsec3 []dns.RR
+	for _, set := range rrsets(resp.Ns) {
+		if err := verifyRRset(set, zone, keys); err != nil {
+			return bogus, fmt.Errorf("authority %s %s: %w", set.rrs[0].Header().Name, dns.Type(set.rrs[0].Header().Rrtype), err)
+		}
+		switch set.rrs[0].Header().Rrtype {
+		case dns.TypeNSEC:
+			nsec = append(nsec, set.rrs...)
+		case dns.TypeNSEC3:
+			nsec3 = append(nsec3, set.rrs...)
+		}
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		merge(provesNXDomain(sname, nsec, nsec3))
+	} else {
+		merge(provesNoData(sname, q.Qtype, nsec, nsec3))
+	}
+	if status == bogus {
+		return bogus, fmt.Errorf("no valid denial of existence for %s", sname)
+	}
+	return status, nil
+}
+
+// checkRRset validates one RRset of an answer. A signed RRset only needs the
+// chain of trust down to its signer; an unsigned one is fine if the chain
+// breaks above it. A wildcard expansion is only secure if authority proves
+// that no closer name exists (RFC 4035 section 5.3.4).
+func (v *validator) checkRRset(set rrset, authority []dns.RR, lookup lookupFunc) (security, error) {
+	h := set.rrs[0].Header()
+	signer := signerOf(set)
+	if signer == "" {
+		name := strings.ToLower(h.Name)
+		if h.Rrtype == dns.TypeDS || h.Rrtype == dns.TypeCNAME {
+			// the parent side of a cut, or a name that can't be one
+			name = parentName(name)
+		}
+		if _, _, s, err := v.zoneOf(name, lookup); s != secure {
+			return s, err
+		}
+		return bogus, fmt.Errorf("%s %s: %w", h.Name, dns.Type(h.Rrtype), errNoSignature)
+	}
+
+	keys, s, err := v.signerKeys(signer, lookup)
+	if s != secure {
+		return s, err
+	}
+	sig, err := verifiedSig(set, signer, keys)
+	if err != nil {
+		return bogus, fmt.Errorf("%s %s: %w", h.Name, dns.Type(h.Rrtype), err)
+	}
+
+	labels := dns.SplitDomainName(strings.ToLower(h.Name))
+	if len(labels) > 0 && labels[0] == "*" {
+		// the wildcard record itself, RRSIG labels don't count the "*"
+		return secure, nil
+	}
+	if int(sig.Labels) >= len(labels) {
+		return secure, nil
+	}
+	nextCloser := dns.Fqdn(strings.Join(labels[len(labels)-int(sig.Labels)-1:], "."))
+	return wildcardProof(nextCloser, signer, keys, authority), nil
+}
+
+// wildcardProof checks that the signed denial records in authority cover
+// nextCloser, the name below the closest encloser a wildcard answer was
+// expanded for. Without such a proof the answer might hide the real records
+// of a closer name, so it's insecure.
+func wildcardProof(nextCloser, signer string, keys []*dns.DNSKEY, authority []dns.RR) security {
+	for _, set := range rrsets(authority) {
+		if verifyRRset(set, signer, keys) != nil {
+			continue
+		}
+		for _, rr := range set.rrs {
+			switch n := rr.(type) {
+			case *dns.NSEC:
+				if covers(n, nextCloser) && !ancestorCut(n, nextCloser) {
+					return secure
+				}
+			case *dns.NSEC3:
+				if n.Cover(nextCloser) {
+					if n.Flags&1 == 1 {
+						return insecure
+					}
+					return secure
+				}
+			}
+		}
+	}
+	return insecure
+}
+
+// signerOf returns the signer of the first RRSIG of set made by a zone the
+// records can live in, "" if there is none.
+func signerOf(set rrset) string {
+	h := set.rrs[0].Header()
+	for _, sig := range set.sigs {
+		signer := dns.Fqdn(strings.ToLower(sig.SignerName))
+		if !dns.IsSubDomain(signer, h.Name) {
+			continue
+		}
+		// a DS is signed by the parent, never by the zone it points to
+		if h.Rrtype == dns.TypeDS && strings.EqualFold(signer, h.Name) {
+			continue
+		}
+		return signer
+	}
+	return ""
+}
+
+// signerKeys returns the keys of the secure zone signer, which the chain of
+// trust must reach as a zone cut.
+func (v *validator) signerKeys(signer string, lookup lookupFunc) ([]*dns.DNSKEY, security, error) {
+	zone, keys, s, err := v.zoneOf(signer, lookup)
+	if s != secure {
+		return nil, s, err
+	}
+	if zone != signer {
+		return nil, bogus, fmt.Errorf("signer %s is not a zone, %s is", signer, zone)
+	}
+	return keys, secure, nil
+}
+
+// zoneOf walks the chain of trust from the root down to name and returns the
+// secure zone containing it with its keys, or reports that the chain breaks
+// at an unsigned delegation on the way. Every label walked is one DS lookup
+// the first time, so callers walk to the signer rather than the owner of the
+// records where they can.
+func (v *validator) zoneOf(name string, lookup lookupFunc) (string, []*dns.DNSKEY, security, error) {
+	zone := "."
+	keys, err := v.rootKeys(lookup)
+	if err != nil {
+		return "", nil, bogus, err
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := dns.Fqdn(strings.ToLower(strings.Join(labels[i:], ".")))
+		e, err := v.delegation(zone, keys, child, lookup)
+		if err != nil {
+			return "", nil, bogus, err
+		}
+		if e.status == insecure {
+			return "", nil, insecure, nil
+		}
+		if e.cut {
+			zone, keys = child, e.keys
+		}
+	}
+	return zone, keys, secure, nil
+}
+
+func (v *validator) cached(name string) (zoneEntry, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	e, ok := v.zones[name]
+	if !ok || time.Now().After(e.expire) {
+		return zoneEntry{}, false
+	}
+	return e, true
+}
+
+func (v *validator) store(name string, e zoneEntry, ttl uint32) {
+	e.expire = time.Now().Add(min(max(time.Duration(ttl)*time.Second, dnssecMinTTL), dnssecMaxTTL))
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.zones) >= dnssecCacheMax {
+		clear(v.zones)
+	}
+	v.zones[name] = e
+}
+
+// rootKeys returns the root DNSKEYs, validated against the trust anchor.
+func (v *validator) rootKeys(lookup lookupFunc) ([]*dns.DNSKEY, error) {
+	if e, ok := v.cached("."); ok {
+		return e.keys, nil
+	}
+	keys, ttl, err := v.zoneKeys(".", v.anchors, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("root keys: %w", err)
+	}
+	v.store(".", zoneEntry{status: secure, cut: true, keys: keys}, ttl)
+	return keys, nil
+}
+
+// zoneKeys fetches the DNSKEY RRset of zone and checks it is signed by a key
+// that one of trusted, DS or DNSKEY records, vouches for.
+func (v *validator) zoneKeys(zone string, trusted []dns.RR, lookup lookupFunc) ([]*dns.DNSKEY, uint32, error) {
+	resp, err := lookup(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, 0, err
+	}
+	var set rrset
+	for _, s := range rrsets(resp.Answer) {
+		if s.rrs[0].Header().Rrtype == dns.TypeDNSKEY && strings.EqualFold(s.rrs[0].Header().Name, zone) {
+			set = s
+		}
+	}
+	if len(set.rrs) == 0 {
+		return nil, 0, fmt.Errorf("no DNSKEY for %s", zone)
+	}
+
+	var keys, anchored []*dns.DNSKEY
+	for _, rr := range set.rrs {
+		k := rr.(*dns.DNSKEY)
+		keys = append(keys, k)
+		if slices.ContainsFunc(trusted, func(t dns.RR) bool { return vouches(t, k) }) {
+			anchored = append(anchored, k)
+		}
+	}
+	if len(anchored) == 0 {
+		return nil, 0, fmt.Errorf("no DNSKEY of %s matches its DS", zone)
+	}
+	if err := verifyRRset(set, zone, anchored); err != nil {
+		return nil, 0, fmt.Errorf("DNSKEY %s: %w", zone, err)
+	}
+	return keys, set.rrs[0].Header().Ttl, nil
+}
+
+// vouches reports whether the trusted DS or DNSKEY record t matches k.
+func vouches(t dns.RR, k *dns.DNSKEY) bool {
+	switch t := t.(type) {
+	case *dns.DS:
+		if t.KeyTag != k.KeyTag() || t.Algorithm != k.Algorithm {
+			return false
+		}
+		ds := k.ToDS(t.DigestType)
+		return ds != nil && strings.EqualFold(ds.Digest, t.Digest)
+	case *dns.DNSKEY:
+		return t.Algorithm == k.Algorithm && t.Flags == k.Flags && t.PublicKey == k.PublicKey
+	}
+	return false
+}
+
+// delegation looks at the DS records of child, a name one label below the
+// secure zone. It's a secure cut if it has a DS RRset signed by zone and a
+// DNSKEY RRset matching it, insecure if zone proves it's delegated without
+// DS, and part of zone otherwise.
+func (v *validator) delegation(zone string, keys []*dns.DNSKEY, child string, lookup lookupFunc) (zoneEntry, error) {
+	if e, ok := v.cached(child); ok {
+		return e, nil
+	}
+
+	resp, err := lookup(child, dns.TypeDS)
+	if err != nil {
+		return zoneEntry{}, err
+	}
+	ttl := uint32(dnssecMaxTTL / time.Second)
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		ttl = min(ttl, rr.Header().Ttl)
+	}
+
+	for _, set := range rrsets(resp.Answer) {
+		h := set.rrs[0].Header()
+		if h.Rrtype != dns.TypeDS || !strings.EqualFold(h.Name, child) {
+			continue
+		}
+		if err := verifyRRset(set, zone, keys); err != nil {
+			return zoneEntry{}, fmt.Errorf("DS %s: %w", child, err)
+		}
+
+		var usable []dns.RR
+		for _, rr := range set.rrs {
+			ds := rr.(*dns.DS)
+			if supportedAlgorithms[ds.Algorithm] && supportedDigests[ds.DigestType] {
+				usable = append(usable, ds)
+			}
+		}
+		if len(usable) == 0 {
+			e := zoneEntry{status: insecure, cut: true}
+			v.store(child, e, ttl)
+			return e, nil
+		}
+
+		childKeys, keyTTL, err := v.zoneKeys(child, usable, lookup)
+		if err != nil {
+			return zoneEntry{}, err
+		}
+		e := zoneEntry{status: secure, cut: true, keys: childKeys}
+		v.store(child, e, min(ttl, keyTTL))
+		return e, nil
+	}
+
+	// no DS: the signed NSEC or NSEC3 records tell an unsigned delegation
+	// from a name inside zone
+	var nsec, nsec3 []dns.RR
+	for _, set := range rrsets(resp.Ns) {
+		switch set.rrs[0].Header().Rrtype {
+		case dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		if err := verifyRRset(set, zone, keys); err != nil {
+			return zoneEntry{}, fmt.Errorf("no DS for %s: %w", child, err)
+		}
+		if set.rrs[0].Header().Rrtype == dns.TypeNSEC {
+			nsec = append(nsec, set.rrs...)
+		} else {
+			nsec3 = append(nsec3, set.rrs...)
+		}
+	}
+	if len(nsec) == 0 && len(nsec3) == 0 {
+		return zoneEntry{}, fmt.Errorf("no DS for %s and no signed denial from %s", child, zone)
+	}
+
+	e := zoneEntry{status: secure}
+	if unsignedDelegation(child, nsec, nsec3) {
+		e = zoneEntry{status: insecure, cut: true}
+	}
+	v.store(child, e, ttl)
+	return e, nil
+}
+
+// unsignedDelegation reports whether the denial records prove that name is
+// delegated without DS, or lies in an opt-out span of an NSEC3 chain.
+func unsignedDelegation(name string, nsec, nsec3 []dns.RR) bool {
+	delegated := func(types []uint16) bool {
+		return isCut(types) && !slices.Contains(types, dns.TypeDS)
+	}
+	for _, rr := range nsec {
+		n := rr.(*dns.NSEC)
+		if strings.EqualFold(n.Hdr.Name, name) {
+			return delegated(n.TypeBitMap)
+		}
+	}
+	for _, rr := range nsec3 {
+		n := rr.(*dns.NSEC3)
+		if n.Match(name) {
+			return delegated(n.TypeBitMap)
+		}
+	}
+	for _, rr := range nsec3 {
+		n := rr.(*dns.NSEC3)
+		if n.Flags&1 == 1 && n.Cover(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isCut reports whether the types of an NSEC or NSEC3 record make its owner
+// a delegation: the parent side of it can't deny anything below or at it but
+// the DS.
+func isCut(types []uint16) bool {
+	return slices.Contains(types, dns.TypeNS) && !slices.Contains(types, dns.TypeSOA)
+}
+
+// provesNoData checks the denial that name has records of qtype.
+func provesNoData(name string, qtype uint16, nsec, nsec3 []dns.RR) security {
+	absent := func(types []uint16) bool {
+		if qtype != dns.TypeDS && isCut(types) {
+			return false
+		}
+		return !slices.Contains(types, qtype) && !slices.Contains(types, dns.TypeCNAME)
+	}
+	for _, rr := range nsec {
+		n := rr.(*dns.NSEC)
+		if strings.EqualFold(n.Hdr.Name, name) && absent(n.TypeBitMap) {
+			return secure
+		}
+		// an empty non-terminal sits between an NSEC and its next name
+		if covers(n, name) && dns.IsSubDomain(name, n.NextDomain) && !ancestorCut(n, name) {
+			return secure
+		}
+	}
+	for _, rr := range nsec3 {
+		n := rr.(*dns.NSEC3)
+		if n.Match(name) && absent(n.TypeBitMap) {
+			return secure
+		}
+	}
+	if qtype == dns.TypeDS {
+		for _, rr := range nsec3 {
+			n := rr.(*dns.NSEC3)
+			if n.Flags&1 == 1 && n.Cover(name) {
+				return insecure
+			}
+		}
+	}
+	return bogus
+}
+
+// provesNXDomain checks the denial that name exists: the name itself and the
+// wildcard that could have matched it must both be covered.
+func provesNXDomain(name string, nsec, nsec3 []dns.RR) security {
+	if len(nsec) > 0 {
+		var encloser string
+		for _, rr := range nsec {
+			n := rr.(*dns.NSEC)
+			if covers(n, name) && !ancestorCut(n, name) {
+				// the closest encloser is the longest ancestor of name
+				// that exists, on either side of the gap
+				encloser = longestCommon(name, n.Hdr.Name, n.NextDomain)
+			}
+		}
+		if encloser == "" {
+			return bogus
+		}
+		wildcard := "*." + strings.TrimPrefix(encloser, ".")
+		if encloser == "." {
+			wildcard = "*."
+		}
+		for _, rr := range nsec {
+			if covers(rr.(*dns.NSEC), wildcard) {
+				return secure
+			}
+		}
+		return bogus
+	}
+
+	// NSEC3: closest encloser proof (RFC 5155 section 8.4)
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser := "."
+		if i < len(labels) {
+			encloser = dns.Fqdn(strings.Join(labels[i:], "."))
+		}
+		j := slices.IndexFunc(nsec3, func(rr dns.RR) bool { return rr.(*dns.NSEC3).Match(encloser) })
+		if j < 0 {
+			continue
+		}
+		if isCut(nsec3[j].(*dns.NSEC3).TypeBitMap) {
+			// names below a delegation are the child's to deny
+			return bogus
+		}
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		optOut := false
+		covered := slices.ContainsFunc(nsec3, func(rr dns.RR) bool {
+			n := rr.(*dns.NSEC3)
+			if n.Cover(nextCloser) {
+				optOut = n.Flags&1 == 1
+				return true
+			}
+			return false
+		})
+		if !covered {
+			return bogus
+		}
+		if optOut {
+			return insecure
+		}
+		wildcard := "*." + encloser
+		if encloser == "." {
+			wildcard = "*."
+		}
+		if slices.ContainsFunc(nsec3, func(rr dns.RR) bool { return rr.(*dns.NSEC3).Cover(wildcard) }) {
+			return secure
+		}
+		return bogus
+	}
+	return bogus
+}
+
+// ancestorCut reports whether n is the parent side NSEC of a delegation
+// above name, which says nothing about name.
+func ancestorCut(n *dns.NSEC, name string) bool {
+	return !strings.EqualFold(n.Hdr.Name, name) && dns.IsSubDomain(n.Hdr.Name, name) && isCut(n.TypeBitMap)
+}
+
+// covers reports whether name falls strictly between the owner and the next
+// name of n in canonical order; the last NSEC of a zone wraps around.
+func covers(n *dns.NSEC, name string) bool {
+	owner, next := n.Hdr.Name, n.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare orders names as RFC 4034 section 6.1 does: label by
+// label from the right, case-insensitively.
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= min(len(la), len(lb)); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// longestCommon returns the longest ancestor of name shared with a or b.
+func longestCommon(name, a, b string) string {
+	best := "."
+	for _, other := range []string{a, b} {
+		n := dns.CompareDomainName(name, other)
+		labels := dns.SplitDomainName(name)
+		if n > 0 && n <= len(labels) && n > dns.CountLabel(best) {
+			best = dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+		}
+	}
+	return strings.ToLower(best)
+}
+
+// rrset is the records sharing a name and type, with the RRSIGs covering
+// them.
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// rrsets groups a message section into RRsets in order of appearance.
+func rrsets(section []dns.RR) []rrset {
+	type key struct {
+		name  string
+		rtype uint16
+	}
+	index := make(map[key]int)
+	var out []rrset
+	for _, rr := range section {
+		h := rr.Header()
+		k := key{strings.ToLower(h.Name), h.Rrtype}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			k.rtype = sig.TypeCovered
+		}
+		i, ok := index[k]
+		if !ok {
+			i = len(out)
+			index[k] = i
+			out = append(out, rrset{})
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			out[i].sigs = append(out[i].sigs, sig)
+		} else {
+			out[i].rrs = append(out[i].rrs, rr)
+		}
+	}
+	// signatures without their records say nothing
+	return slices.DeleteFunc(out, func(s rrset) bool { return len(s.rrs) == 0 })
+}
+
+var errNoSignature = errors.New("no valid signature")
+
+// verifyRRset checks that one of the signatures of set was made by one of
+// the keys of zone and is currently valid.
+func verifyRRset(set rrset, zone string, keys []*dns.DNSKEY) error {
+	_, err := verifiedSig(set, zone, keys)
+	return err
+}
+
+// verifiedSig is verifyRRset returning the signature that checked out.
+func verifiedSig(set rrset, zone string, keys []*dns.DNSKEY) (*dns.RRSIG, error) {
+	now := time.Now()
+	err := errNoSignature
+	for _, sig := range set.sigs {
+		if !strings.EqualFold(sig.SignerName, zone) {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			err = fmt.Errorf("signature by %s expired or not yet valid", sig.SignerName)
+			continue
+		}
+		for _, k := range keys {
+			if k.Flags&dns.ZONE == 0 || k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+				continue
+			}
+			err = sig.Verify(k, set.rrs)
+			if err == nil {
+				return sig, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+func parentName(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+// stripDNSSEC removes the DNSSEC records a client without DO didn't ask for.
+func stripDNSSEC(resp *dns.Msg, qtype uint16) {
+	strip := func(rrs []dns.RR) []dns.RR {
+		return slices.DeleteFunc(rrs, func(rr dns.RR) bool {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				return t != qtype
+			}
+			return false
+		})
+	}
+	resp.Answer = strip(resp.Answer)
+	resp.Ns = strip(resp.Ns)
+}
+
+// bogusReply is the SERVFAIL for an answer that failed validation, with an
+// extended error (RFC 8914) telling why.
+func bogusReply(req *dns.Msg, reason error) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeServerFailure)
+	resp.RecursionAvailable = true
+	if req.IsEdns0() != nil {
+		resp.SetEdns0(dnssecUDPSize, false)
+		opt := resp.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeDNSBogus,
+			ExtraText: reason.Error(),
+		})
+	}
+	return resp
+}
+
+// dnssecLookup asks the upstreams for the DNSSEC records the validator
+// needs, routed like any other query.
+func (st *state) dnssecLookup(name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(dnssecUDPSize, true)
+	req.CheckingDisabled = true
+
+	g := st.router.route(name)
+	resp, _, err := g.policy.exchange(g.upstreams, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: got %s", name, dns.Type(qtype), dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
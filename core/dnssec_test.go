@@ -0,0 +1,464 @@
+package core
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Fixed validity period of the test signatures.
+var (
+	testInception  = uint32(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+	testExpiration = uint32(time.Date(2060, 1, 1, 0, 0, 0, 0, time.UTC).Unix())
+)
+
+// testZone is a signed zone with one ED25519 key derived from a fixed seed.
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv ed25519.PrivateKey
+}
+
+func newTestZone(name string, seed byte) *testZone {
+	priv := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ED25519,
+		PublicKey: base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+	}
+	return &testZone{name: name, key: key, priv: priv}
+}
+
+// sign returns rrs, one RRset, followed by its RRSIG.
+func (z *testZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Algorithm:  dns.ED25519,
+		SignerName: z.name,
+		KeyTag:     z.key.KeyTag(),
+		Inception:  testInception,
+		Expiration: testExpiration,
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatalf("sign %s: %v", rrs[0].Header().Name, err)
+	}
+	return append(rrs, sig)
+}
+
+func testRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("parse %q: %v", s, err)
+	}
+	return rr
+}
+
+// rename moves the records of a signed RRset to name, the way a server
+// expands a wildcard.
+func rename(rrs []dns.RR, name string) []dns.RR {
+	for _, rr := range rrs {
+		rr.Header().Name = name
+	}
+	return rrs
+}
+
+func testMsg(qname string, qtype uint16, rcode int, answer, ns []dns.RR) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(qname, qtype)
+	m.Response = true
+	m.Rcode = rcode
+	m.Answer = answer
+	m.Ns = ns
+	return m
+}
+
+// testChain is a root zone delegating securely to example., which has an
+// unsigned delegation to unsigned.example.
+type testChain struct {
+	root, example *testZone
+	anchor        dns.RR
+	answers       map[string]*dns.Msg
+}
+
+func newTestChain(t *testing.T) *testChain {
+	c := &testChain{
+		root:    newTestZone(".", 1),
+		example: newTestZone("example.", 2),
+		answers: make(map[string]*dns.Msg),
+	}
+	c.anchor = c.root.key
+
+	c.add(testMsg(".", dns.TypeDNSKEY, dns.RcodeSuccess, c.root.sign(t, c.root.key), nil))
+	c.add(testMsg("example.", dns.TypeDS, dns.RcodeSuccess, c.root.sign(t, c.example.key.ToDS(dns.SHA256)), nil))
+	c.add(testMsg("example.", dns.TypeDNSKEY, dns.RcodeSuccess, c.example.sign(t, c.example.key), nil))
+	c.add(testMsg("unsigned.example.", dns.TypeDS, dns.RcodeSuccess, nil,
+		c.example.sign(t, testRR(t, "unsigned.example. 300 IN NSEC www.example. NS RRSIG NSEC"))))
+	return c
+}
+
+func (c *testChain) add(m *dns.Msg) {
+	q := m.Question[0]
+	c.answers[fmt.Sprintf("%s %d", q.Name, q.Qtype)] = m
+}
+
+// lookup answers from the fixtures only, any other query is an error.
+func (c *testChain) lookup(name string, qtype uint16) (*dns.Msg, error) {
+	m, ok := c.answers[fmt.Sprintf("%s %d", name, qtype)]
+	if !ok {
+		return nil, fmt.Errorf("unexpected lookup %s %s", name, dns.Type(qtype))
+	}
+	return m.Copy(), nil
+}
+
+func (c *testChain) validator() *validator {
+	return &validator{anchors: []dns.RR{c.anchor}, zones: make(map[string]zoneEntry)}
+}
+
+func TestValidate(t *testing.T) {
+	c := newTestChain(t)
+	ex := c.example
+	rr := func(s string) dns.RR { return testRR(t, s) }
+	join := func(sets ...[]dns.RR) []dns.RR {
+		var out []dns.RR
+		for _, s := range sets {
+			out = append(out, s...)
+		}
+		return out
+	}
+
+	tampered := ex.sign(t, rr("www.example. 300 IN A 192.0.2.1"))
+	tampered[0].(*dns.A).A[3] = 2
+
+	exampleHash := dns.HashName("example.", dns.SHA1, 0, "")
+	nsec3 := func(flags uint8) dns.RR {
+		// the only NSEC3 of the zone covers every other hash
+		return rr(fmt.Sprintf("%s.example. 300 IN NSEC3 1 %d 0 - %s NS SOA RRSIG DNSKEY NSEC3PARAM", exampleHash, flags, exampleHash))
+	}
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		rcode   int
+		answer  []dns.RR
+		ns      []dns.RR
+		want    security
+		wantErr bool
+	}{{
+		name:   "signed answer",
+		qname:  "www.example.",
+		qtype:  dns.TypeA,
+		answer: ex.sign(t, rr("www.example. 300 IN A 192.0.2.1")),
+		want:   secure,
+	}, {
+		name:    "tampered answer",
+		qname:   "www.example.",
+		qtype:   dns.TypeA,
+		answer:  tampered,
+		want:    bogus,
+		wantErr: true,
+	}, {
+		name:    "unsigned answer in a signed zone",
+		qname:   "www.example.",
+		qtype:   dns.TypeA,
+		answer:  []dns.RR{rr("www.example. 300 IN A 192.0.2.1")},
+		want:    bogus,
+		wantErr: true,
+	}, {
+		// no DS lookup for www.example., the chain only goes to the signer
+		name:  "cname",
+		qname: "www.example.",
+		qtype: dns.TypeA,
+		answer: join(
+			ex.sign(t, rr("www.example. 300 IN CNAME alias.example.")),
+			ex.sign(t, rr("alias.example. 300 IN A 192.0.2.1")),
+		),
+		want: secure,
+	}, {
+		name:   "cname asked for",
+		qname:  "www.example.",
+		qtype:  dns.TypeCNAME,
+		answer: ex.sign(t, rr("www.example. 300 IN CNAME alias.example.")),
+		want:   secure,
+	}, {
+		// a signed RRset of the zone, but not the one asked for
+		name:    "answer for another name",
+		qname:   "www.example.",
+		qtype:   dns.TypeA,
+		answer:  ex.sign(t, rr("other.example. 300 IN A 192.0.2.1")),
+		want:    bogus,
+		wantErr: true,
+	}, {
+		name:  "cname target answered by another name",
+		qname: "www.example.",
+		qtype: dns.TypeA,
+		answer: join(
+			ex.sign(t, rr("www.example. 300 IN CNAME alias.example.")),
+			ex.sign(t, rr("other.example. 300 IN A 192.0.2.1")),
+		),
+		want:    bogus,
+		wantErr: true,
+	}, {
+		name:  "cname into an unsigned zone",
+		qname: "www.example.",
+		qtype: dns.TypeA,
+		answer: join(
+			ex.sign(t, rr("www.example. 300 IN CNAME host.unsigned.example.")),
+			[]dns.RR{rr("host.unsigned.example. 300 IN A 192.0.2.1")},
+		),
+		want: insecure,
+	}, {
+		name:   "unsigned delegation",
+		qname:  "host.unsigned.example.",
+		qtype:  dns.TypeA,
+		answer: []dns.RR{rr("host.unsigned.example. 300 IN A 192.0.2.1")},
+		want:   insecure,
+	}, {
+		name:   "wildcard with next closer denial",
+		qname:  "host.wild.example.",
+		qtype:  dns.TypeA,
+		answer: rename(ex.sign(t, rr("*.wild.example. 300 IN A 192.0.2.1")), "host.wild.example."),
+		ns:     ex.sign(t, rr("*.wild.example. 300 IN NSEC www.example. A RRSIG NSEC")),
+		want:   secure,
+	}, {
+		name:   "wildcard without denial",
+		qname:  "host.wild.example.",
+		qtype:  dns.TypeA,
+		answer: rename(ex.sign(t, rr("*.wild.example. 300 IN A 192.0.2.1")), "host.wild.example."),
+		want:   insecure,
+	}, {
+		name:   "wildcard with unsigned denial",
+		qname:  "host.wild.example.",
+		qtype:  dns.TypeA,
+		answer: rename(ex.sign(t, rr("*.wild.example. 300 IN A 192.0.2.1")), "host.wild.example."),
+		ns:     []dns.RR{rr("*.wild.example. 300 IN NSEC www.example. A RRSIG NSEC")},
+		want:   insecure,
+	}, {
+		name:   "wildcard owner asked for",
+		qname:  "*.wild.example.",
+		qtype:  dns.TypeA,
+		answer: ex.sign(t, rr("*.wild.example. 300 IN A 192.0.2.1")),
+		want:   secure,
+	}, {
+		name:  "nxdomain",
+		qname: "missing.example.",
+		qtype: dns.TypeA,
+		rcode: dns.RcodeNameError,
+		ns: join(
+			ex.sign(t, rr("example. 300 IN NSEC alias.example. NS SOA RRSIG NSEC DNSKEY")),
+			ex.sign(t, rr("alias.example. 300 IN NSEC www.example. A RRSIG NSEC")),
+		),
+		want: secure,
+	}, {
+		name:    "nxdomain without wildcard denial",
+		qname:   "missing.example.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeNameError,
+		ns:      ex.sign(t, rr("alias.example. 300 IN NSEC www.example. A RRSIG NSEC")),
+		want:    bogus,
+		wantErr: true,
+	}, {
+		name:    "nxdomain below an unsigned delegation",
+		qname:   "host.unsigned.example.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeNameError,
+		ns:      ex.sign(t, rr("unsigned.example. 300 IN NSEC www.example. NS RRSIG NSEC")),
+		want:    bogus,
+		wantErr: true,
+	}, {
+		name:  "nodata",
+		qname: "www.example.",
+		qtype: dns.TypeAAAA,
+		ns:    ex.sign(t, rr("www.example. 300 IN NSEC example. A RRSIG NSEC")),
+		want:  secure,
+	}, {
+		name:  "empty non-terminal",
+		qname: "ent.example.",
+		qtype: dns.TypeA,
+		ns:    ex.sign(t, rr("alias.example. 300 IN NSEC host.ent.example. A RRSIG NSEC")),
+		want:  secure,
+	}, {
+		name:  "nsec3 nxdomain",
+		qname: "missing.example.",
+		qtype: dns.TypeA,
+		rcode: dns.RcodeNameError,
+		ns:    ex.sign(t, nsec3(0)),
+		want:  secure,
+	}, {
+		name:  "nsec3 opt-out",
+		qname: "missing.example.",
+		qtype: dns.TypeA,
+		rcode: dns.RcodeNameError,
+		ns:    ex.sign(t, nsec3(1)),
+		want:  insecure,
+	}, {
+		name:    "denial from the parent zone",
+		qname:   "missing.example.",
+		qtype:   dns.TypeA,
+		rcode:   dns.RcodeNameError,
+		ns:      c.root.sign(t, rr("example. 300 IN NSEC net. NS DS RRSIG NSEC")),
+		want:    bogus,
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := testMsg(tt.qname, tt.qtype, tt.rcode, tt.answer, tt.ns)
+			got, err := c.validator().validate(resp, c.lookup)
+			if got != tt.want {
+				t.Errorf("validate = %d (%v), want %d", got, err, tt.want)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate err = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCanonicalCompare(t *testing.T) {
+	// the example of RFC 4034 section 6.1 without the escaped labels
+	ordered := []string{
+		"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.",
+		"zABC.a.EXAMPLE.", "z.example.", "*.z.example.", "a.z.example.",
+	}
+	for i := range ordered {
+		for j := range ordered {
+			got := canonicalCompare(ordered[i], ordered[j])
+			switch {
+			case i < j && got >= 0, i > j && got <= 0, i == j && got != 0:
+				t.Errorf("canonicalCompare(%q, %q) = %d", ordered[i], ordered[j], got)
+			}
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		nsec string
+		name string
+		want bool
+	}{
+		{"alias.example. NSEC www.example. A", "host.example.", true},
+		{"alias.example. NSEC www.example. A", "alias.example.", false},
+		{"alias.example. NSEC www.example. A", "www.example.", false},
+		{"alias.example. NSEC www.example. A", "zzz.example.", false},
+		{"alias.example. NSEC www.example. A", "host.ent.example.", true},
+		// the last NSEC wraps around to the apex
+		{"www.example. NSEC example. A", "zzz.example.", true},
+		{"www.example. NSEC example. A", "host.example.", false},
+	}
+	for _, tt := range tests {
+		if got := covers(testRR(t, tt.nsec).(*dns.NSEC), tt.name); got != tt.want {
+			t.Errorf("covers(%q, %q) = %t, want %t", tt.nsec, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProvesNoData(t *testing.T) {
+	hash := func(name string) string {
+		return strings.ToLower(dns.HashName(name, dns.SHA1, 0, ""))
+	}
+	nsec3 := func(owner string, flags uint8, next, types string) dns.RR {
+		return testRR(t, fmt.Sprintf("%s.example. NSEC3 1 %d 0 - %s %s", hash(owner), flags, dns.HashName(next, dns.SHA1, 0, ""), types))
+	}
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		nsec  []string
+		nsec3 []dns.RR
+		want  security
+	}{{
+		name:  "type absent",
+		qname: "www.example.",
+		qtype: dns.TypeAAAA,
+		nsec:  []string{"www.example. NSEC example. A RRSIG NSEC"},
+		want:  secure,
+	}, {
+		name:  "type present",
+		qname: "www.example.",
+		qtype: dns.TypeA,
+		nsec:  []string{"www.example. NSEC example. A RRSIG NSEC"},
+		want:  bogus,
+	}, {
+		name:  "cname present",
+		qname: "www.example.",
+		qtype: dns.TypeA,
+		nsec:  []string{"www.example. NSEC example. CNAME RRSIG NSEC"},
+		want:  bogus,
+	}, {
+		name:  "delegation from the parent side",
+		qname: "sub.example.",
+		qtype: dns.TypeA,
+		nsec:  []string{"sub.example. NSEC www.example. NS RRSIG NSEC"},
+		want:  bogus,
+	}, {
+		name:  "no DS at a delegation",
+		qname: "sub.example.",
+		qtype: dns.TypeDS,
+		nsec:  []string{"sub.example. NSEC www.example. NS RRSIG NSEC"},
+		want:  secure,
+	}, {
+		name:  "empty non-terminal",
+		qname: "ent.example.",
+		qtype: dns.TypeA,
+		nsec:  []string{"alias.example. NSEC host.ent.example. A RRSIG NSEC"},
+		want:  secure,
+	}, {
+		name:  "empty non-terminal below a delegation",
+		qname: "ent.sub.example.",
+		qtype: dns.TypeA,
+		nsec:  []string{"sub.example. NSEC host.ent.sub.example. NS RRSIG NSEC"},
+		want:  bogus,
+	}, {
+		name:  "nsec3 type absent",
+		qname: "www.example.",
+		qtype: dns.TypeAAAA,
+		nsec3: []dns.RR{nsec3("www.example.", 0, "www.example.", "A RRSIG")},
+		want:  secure,
+	}, {
+		name:  "nsec3 DS in an opt-out span",
+		qname: "sub.example.",
+		qtype: dns.TypeDS,
+		nsec3: []dns.RR{
+			nsec3("example.", 1, "example.", "NS SOA RRSIG DNSKEY NSEC3PARAM"),
+		},
+		want: insecure,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nsec []dns.RR
+			for _, s := range tt.nsec {
+				nsec = append(nsec, testRR(t, s))
+			}
+			if got := provesNoData(tt.qname, tt.qtype, nsec, tt.nsec3); got != tt.want {
+				t.Errorf("provesNoData = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnsignedDelegation(t *testing.T) {
+	tests := []struct {
+		nsec string
+		want bool
+	}{
+		{"sub.example. NSEC www.example. NS RRSIG NSEC", true},
+		{"sub.example. NSEC www.example. NS DS RRSIG NSEC", false},
+		{"sub.example. NSEC www.example. A RRSIG NSEC", false},
+		{"sub.example. NSEC www.example. NS SOA RRSIG NSEC", false},
+	}
+	for _, tt := range tests {
+		if got := unsignedDelegation("sub.example.", []dns.RR{testRR(t, tt.nsec)}, nil); got != tt.want {
+			t.Errorf("unsignedDelegation(%q) = %t, want %t", tt.nsec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"df/conf"
+	"df/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// startHealthCheck probes u in the background until u is closed.
+func (u *upstreamClient) startHealthCheck(opts conf.HealthCheckOptions) {
+	metrics.UpstreamHealthy.WithLabelValues(u.group, u.label).Set(1)
+	if opts.Disable {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	u.stopHealth = cancel
+	go u.healthCheck(ctx, opts)
+}
+
+// Close stops the health check and the bootstrap refreshes and closes the
+// upstream. The health gauge is left to closeGroups, which knows whether a
+// replacement took over the series.
+func (u *upstreamClient) Close() error {
+	if u.stopHealth != nil {
+		u.stopHealth()
+	}
+	if u.bootstrap != nil {
+		u.bootstrap.Close()
+	}
+	return u.Upstream.Close()
+}
+
+func (u *upstreamClient) healthy() bool {
+	return !u.down.Load()
+}
+
+func (u *upstreamClient) healthCheck(ctx context.Context, opts conf.HealthCheckOptions) {
+	interval := time.Duration(opts.Interval) * time.Second
+	maxBackoff := max(time.Duration(opts.MaxBackoff)*time.Second, interval)
+	qtype := dns.StringToType[strings.ToUpper(opts.Type)]
+
+	wait, failures := interval, 0
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		err := u.probe(opts.Name, qtype)
+		if ctx.Err() != nil {
+			// closed while probing
+			return
+		}
+
+		switch {
+		case err == nil && !u.healthy():
+			u.down.Store(false)
+			slog.Info("upstream healthy again", "upstream", u.label)
+			failures, wait = 0, interval
+		case err == nil:
+			failures = 0
+		case !u.healthy():
+			wait = min(wait*2, maxBackoff)
+		default:
+			failures++
+			slog.Debug("upstream health check failed", "upstream", u.label, "failures", failures, "err", err)
+			if failures >= opts.Failures {
+				u.down.Store(true)
+				slog.Warn("upstream unhealthy, removed from selection", "upstream", u.label, "err", err)
+				wait = interval
+			}
+		}
+
+		healthy := 0.0
+		if u.healthy() {
+			healthy = 1
+		}
+		metrics.UpstreamHealthy.WithLabelValues(u.group, u.label).Set(healthy)
+		timer.Reset(wait)
+	}
+}
+
+// probe sends one health check query. Answers meaning the upstream can't
+// resolve anything count as failures too.
+func (u *upstreamClient) probe(name string, qtype uint16) error {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	// not a client query, kept out of the request statistics
+	resp, err := u.Upstream.Exchange(req)
+	if err != nil {
+		return err
+	}
+	switch resp.Rcode {
+	case dns.RcodeServerFailure, dns.RcodeRefused:
+		return fmt.Errorf("got %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// healthyUpstreams filters out the ejected upstreams. If all of them are
+// down they're all returned, a slim chance beats failing every query.
+func healthyUpstreams(ups []*upstreamClient) []*upstreamClient {
+	n := 0
+	for _, u := range ups {
+		if u.healthy() {
+			n++
+		}
+	}
+	if n == len(ups) || n == 0 {
+		return ups
+	}
+
+	out := make([]*upstreamClient, 0, n)
+	for _, u := range ups {
+		if u.healthy() {
+			out = append(out, u)
+		}
+	}
+	return out
+}
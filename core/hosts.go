@@ -0,0 +1,226 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain bounds the CNAMEs followed within the local records.
+const maxCNAMEChain = 8
+
+// localZone answers for the names of the hosts section. Names are stored
+// lower case and fully qualified.
+type localZone struct {
+	ttl     uint32
+	addrs   map[string][]netip.Addr
+	ptrs    map[string][]string // reverse name -> host names
+	records map[string][]dns.RR
+}
+
+func newLocalZone(cfg conf.HostsConfig) (*localZone, error) {
+	z := &localZone{
+		ttl:     uint32(cfg.TTL),
+		addrs:   make(map[string][]netip.Addr),
+		ptrs:    make(map[string][]string),
+		records: make(map[string][]dns.RR),
+	}
+	for name, addrs := range cfg.StaticAddrs {
+		for _, addr := range addrs {
+			z.addHost(name, addr)
+		}
+	}
+	for _, f := range cfg.Files {
+		path, err := conf.FilePath(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := z.loadHostsFile(path); err != nil {
+			return nil, fmt.Errorf("hosts file %s: %w", f, err)
+		}
+	}
+	for _, v := range cfg.Records {
+		// a record without a TTL of its own gets the hosts one
+		rr, err := dns.NewRR(fmt.Sprintf("$TTL %d\n%s", z.ttl, v))
+		if err != nil {
+			return nil, fmt.Errorf("hosts record %q: %w", v, err)
+		}
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		z.records[rr.Header().Name] = append(z.records[rr.Header().Name], rr)
+	}
+	return z, nil
+}
+
+func (z *localZone) empty() bool {
+	return len(z.addrs) == 0 && len(z.records) == 0
+}
+
+func (z *localZone) known(name string) bool {
+	_, host := z.addrs[name]
+	_, rec := z.records[name]
+	return host || rec
+}
+
+func (z *localZone) addHost(name string, addr netip.Addr) {
+	name = dns.Fqdn(strings.ToLower(name))
+	addr = addr.Unmap()
+	z.addrs[name] = append(z.addrs[name], addr)
+
+	rev, err := dns.ReverseAddr(addr.String())
+	if err == nil {
+		z.ptrs[rev] = append(z.ptrs[rev], name)
+	}
+}
+
+// loadHostsFile reads a file in /etc/hosts format: an address followed by
+// its names, # starts a comment.
+func (z *localZone) loadHostsFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || addr.Zone() != "" {
+			continue
+		}
+		for _, name := range fields[1:] {
+			if _, ok := dns.IsDomainName(name); ok {
+				z.addHost(name, addr)
+			}
+		}
+	}
+	return sc.Err()
+}
+
+// lookup returns the local records of name and qtype.
+func (z *localZone) lookup(name string, qtype uint16) []dns.RR {
+	var out []dns.RR
+	hdr := func(t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: t, Class: dns.ClassINET, Ttl: z.ttl}
+	}
+	switch qtype {
+	case dns.TypeA:
+		for _, a := range z.addrs[name] {
+			if a.Is4() {
+				out = append(out, &dns.A{Hdr: hdr(dns.TypeA), A: a.AsSlice()})
+			}
+		}
+	case dns.TypeAAAA:
+		for _, a := range z.addrs[name] {
+			if a.Is6() {
+				out = append(out, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: a.AsSlice()})
+			}
+		}
+	case dns.TypePTR:
+		for _, host := range z.ptrs[name] {
+			out = append(out, &dns.PTR{Hdr: hdr(dns.TypePTR), Ptr: host})
+		}
+	}
+	for _, rr := range z.records[name] {
+		if rr.Header().Rrtype == qtype {
+			out = append(out, dns.Copy(rr))
+		}
+	}
+	return out
+}
+
+// answer builds the authoritative reply to req if its name is local. A CNAME
+// is followed as long as the chain stays local; otherwise the name it ends
+// at is returned in chase for the caller to resolve.
+//
+// A/AAAA queries for a host without an address of that family get an empty
+// answer, other types nobody configured go upstream.
+func (z *localZone) answer(req *dns.Msg) (resp *dns.Msg, chase string) {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil, ""
+	}
+	name := strings.ToLower(q.Name)
+
+	answer := z.lookup(name, q.Qtype)
+	for i := 0; len(answer) == 0 || answer[len(answer)-1].Header().Rrtype == dns.TypeCNAME; i++ {
+		if q.Qtype == dns.TypeCNAME || i == maxCNAMEChain {
+			break
+		}
+		cname := z.lookup(name, dns.TypeCNAME)
+		if len(cname) == 0 {
+			if len(answer) > 0 && !z.known(name) {
+				// the chain leaves the local names
+				chase = name
+			}
+			break
+		}
+		answer = append(answer, cname[0])
+		name = strings.ToLower(cname[0].(*dns.CNAME).Target)
+		answer = append(answer, z.lookup(name, q.Qtype)...)
+	}
+
+	if len(answer) == 0 {
+		_, host := z.addrs[name]
+		if !host || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+			return nil, ""
+		}
+	}
+
+	resp = new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	resp.Answer = answer
+	return resp, chase
+}
+
+// watchHosts rebuilds the local zone in dst whenever one of the hosts files
+// changes on disk, until ctx is done.
+func watchHosts(ctx context.Context, cfg conf.HostsConfig, dst *atomic.Pointer[localZone]) {
+	if len(cfg.Files) == 0 {
+		return
+	}
+
+	last := ruleSetStamps(cfg.Files)
+	ticker := time.NewTicker(ruleSetPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cur := ruleSetStamps(cfg.Files)
+		if cur == last {
+			continue
+		}
+
+		z, err := newLocalZone(cfg)
+		if err != nil {
+			slog.Error("reload hosts files", "err", err)
+			continue
+		}
+		last = cur
+		dst.Store(z)
+		slog.Info("hosts files reloaded")
+	}
+}
@@ -0,0 +1,110 @@
+package core
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+func TestLocalZoneAnswer(t *testing.T) {
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	err := os.WriteFile(hosts, []byte(`# comment
+192.0.2.20 nas.lan nas # trailing comment
+fe80::1%eth0 skipped.lan
+bogus
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := newLocalZone(conf.HostsConfig{
+		TTL: 300,
+		StaticAddrs: map[string][]netip.Addr{
+			"Router.LAN": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+			"v4only.lan": {netip.MustParseAddr("::ffff:192.0.2.4")},
+		},
+		Files: []string{hosts},
+		Records: []string{
+			"mail.lan. MX 10 router.lan.",
+			"txt.lan. 60 TXT \"explicit ttl\"",
+			"www.lan. CNAME router.lan.",
+			"cdn.lan. CNAME cdn.example.com.",
+			"loop.lan. CNAME loop.lan.",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		local  bool // answered here
+		answer []string
+		chase  string
+	}{
+		{name: "static A", qname: "router.lan.", qtype: dns.TypeA, local: true,
+			answer: []string{"router.lan. 300 IN A 192.0.2.1"}},
+		{name: "static case insensitive", qname: "ROUTER.lan.", qtype: dns.TypeAAAA, local: true,
+			answer: []string{"router.lan. 300 IN AAAA 2001:db8::1"}},
+		{name: "mapped address is IPv4", qname: "v4only.lan.", qtype: dns.TypeA, local: true,
+			answer: []string{"v4only.lan. 300 IN A 192.0.2.4"}},
+		{name: "missing family is empty", qname: "v4only.lan.", qtype: dns.TypeAAAA, local: true},
+		{name: "other type of a host goes upstream", qname: "router.lan.", qtype: dns.TypeTXT},
+		{name: "hosts file", qname: "nas.", qtype: dns.TypeA, local: true,
+			answer: []string{"nas. 300 IN A 192.0.2.20"}},
+		{name: "hosts file skips zones", qname: "skipped.lan.", qtype: dns.TypeAAAA},
+		{name: "ptr", qname: "1.2.0.192.in-addr.arpa.", qtype: dns.TypePTR, local: true,
+			answer: []string{"1.2.0.192.in-addr.arpa. 300 IN PTR router.lan."}},
+		{name: "record gets the hosts ttl", qname: "mail.lan.", qtype: dns.TypeMX, local: true,
+			answer: []string{"mail.lan. 300 IN MX 10 router.lan."}},
+		{name: "record keeps its ttl", qname: "txt.lan.", qtype: dns.TypeTXT, local: true,
+			answer: []string{`txt.lan. 60 IN TXT "explicit ttl"`}},
+		{name: "local cname", qname: "www.lan.", qtype: dns.TypeA, local: true,
+			answer: []string{"www.lan. 300 IN CNAME router.lan.", "router.lan. 300 IN A 192.0.2.1"}},
+		{name: "cname asked for", qname: "www.lan.", qtype: dns.TypeCNAME, local: true,
+			answer: []string{"www.lan. 300 IN CNAME router.lan."}},
+		{name: "cname leaving the zone", qname: "cdn.lan.", qtype: dns.TypeA, local: true,
+			answer: []string{"cdn.lan. 300 IN CNAME cdn.example.com."}, chase: "cdn.example.com."},
+		{name: "unknown", qname: "example.com.", qtype: dns.TypeA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg).SetQuestion(tt.qname, tt.qtype)
+			resp, chase := z.answer(req)
+			if (resp != nil) != tt.local {
+				t.Fatalf("answered = %t, want %t", resp != nil, tt.local)
+			}
+			if chase != tt.chase {
+				t.Errorf("chase = %q, want %q", chase, tt.chase)
+			}
+			if resp == nil {
+				return
+			}
+			if !resp.Authoritative || resp.Rcode != dns.RcodeSuccess {
+				t.Errorf("aa = %t rcode = %s", resp.Authoritative, dns.RcodeToString[resp.Rcode])
+			}
+			var got, want []string
+			for _, rr := range resp.Answer {
+				got = append(got, rr.String())
+			}
+			for _, s := range tt.answer {
+				want = append(want, testRR(t, s).String())
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("answer = %q, want %q", got, want)
+			}
+		})
+	}
+
+	resp, _ := z.answer(new(dns.Msg).SetQuestion("loop.lan.", dns.TypeA))
+	if resp == nil || len(resp.Answer) > maxCNAMEChain+1 {
+		t.Errorf("cname loop answer = %v", resp)
+	}
+}
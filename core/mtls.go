@@ -0,0 +1,231 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"df/conf"
+
+	UP "github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// clientCertIdle is the number of DoT connections kept for reuse.
+const clientCertIdle = 4
+
+// clientCertUpstream is a DNS over TLS or HTTPS upstream presenting a client
+// certificate, which the dnsproxy upstreams can't do.
+type clientCertUpstream struct {
+	url      *url.URL
+	hostPort string
+	tls      *tls.Config
+	timeout  time.Duration
+	resolver UP.Resolver
+
+	idle chan *dns.Conn // tls:// only
+	http *http.Client   // https:// only
+}
+
+var _ UP.Upstream = (*clientCertUpstream)(nil)
+
+func newClientCertUpstream(uu *url.URL, uc conf.Upstream, opts *UP.Options) (*clientCertUpstream, error) {
+	cert, err := tls.LoadX509KeyPair(uc.TLS.ClientCert, uc.TLS.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate: %w", err)
+	}
+
+	u := &clientCertUpstream{
+		url: uu,
+		tls: &tls.Config{
+			ServerName:         uu.Hostname(),
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: opts.InsecureSkipVerify,
+			MinVersion:         tls.VersionTLS12,
+		},
+		timeout:  opts.Timeout,
+		resolver: opts.Bootstrap,
+	}
+
+	port := uu.Port()
+	switch uu.Scheme {
+	case "tls":
+		if port == "" {
+			port = "853"
+		}
+		u.idle = make(chan *dns.Conn, clientCertIdle)
+	case "https":
+		if port == "" {
+			port = "443"
+		}
+		tr := &http.Transport{
+			DialContext:       u.dial,
+			TLSClientConfig:   u.tls,
+			ForceAttemptHTTP2: slices.Contains(opts.HTTPVersions, UP.HTTPVersion2),
+			IdleConnTimeout:   90 * time.Second,
+		}
+		if !tr.ForceAttemptHTTP2 {
+			// a non-nil empty map turns HTTP/2 off
+			tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+		u.http = &http.Client{Transport: tr, Timeout: u.timeout}
+	default:
+		return nil, fmt.Errorf("client certificates need a tls:// or https:// upstream")
+	}
+	u.hostPort = net.JoinHostPort(uu.Hostname(), port)
+	return u, nil
+}
+
+func (u *clientCertUpstream) Address() string {
+	return u.url.String()
+}
+
+func (u *clientCertUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	if u.http != nil {
+		return u.exchangeHTTPS(req)
+	}
+
+	// a pooled connection may have been closed by the server meanwhile, a
+	// fresh one gets a second chance
+	select {
+	case c := <-u.idle:
+		if resp, err := u.exchangeConn(c, req); err == nil {
+			return resp, nil
+		}
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout)
+	defer cancel()
+	conn, err := u.dial(ctx, "tcp", u.hostPort)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(conn, u.tls)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return u.exchangeConn(&dns.Conn{Conn: tc}, req)
+}
+
+// exchangeConn sends req over c, which goes back to the pool if it worked.
+func (u *clientCertUpstream) exchangeConn(c *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	c.SetDeadline(time.Now().Add(u.timeout))
+	resp, err := func() (*dns.Msg, error) {
+		if err := c.WriteMsg(req); err != nil {
+			return nil, err
+		}
+		return c.ReadMsg()
+	}()
+	if err == nil && resp.Id != req.Id {
+		err = dns.ErrId
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	select {
+	case u.idle <- c:
+	default:
+		c.Close()
+	}
+	return resp, nil
+}
+
+func (u *clientCertUpstream) exchangeHTTPS(req *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 asks for ID 0 so the responses are cacheable
+	id := req.Id
+	req.Id = 0
+	packed, err := req.Pack()
+	req.Id = id
+	if err != nil {
+		return nil, err
+	}
+
+	hreq, err := http.NewRequest(http.MethodPost, u.url.String(), bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/dns-message")
+	hreq.Header.Set("Accept", "application/dns-message")
+	hresp, err := u.http.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", u.url, hresp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(hresp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	resp.Id = id
+	return resp, nil
+}
+
+// dial connects to addr, whose host is resolved through the bootstrap
+// resolver unless it's an IP.
+func (u *clientCertUpstream) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []netip.Addr{}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = append(ips, ip)
+	} else if ips, err = u.resolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+
+	d := &net.Dialer{Timeout: u.timeout}
+	var errs []error
+	for _, ip := range ips {
+		conn, err := d.DialContext(ctx, network, netip.AddrPortFrom(ip, uint16(port)).String())
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no address for %s", host)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (u *clientCertUpstream) Close() error {
+	if u.http != nil {
+		u.http.CloseIdleConnections()
+		return nil
+	}
+	for {
+		select {
+		case c := <-u.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package core
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"df/conf"
+	"df/metrics"
+
+	UP "github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+const (
+	// ewmaWeight is the weight of the newest sample.
+	ewmaWeight = 0.2
+	// errorPenalty is recorded as the RTT of a failed exchange.
+	errorPenalty = 3 * time.Second
+	// fastestExplore makes every Nth query of the fastest policy go to all
+	// upstreams, so the statistics of the others don't go stale. Each one
+	// records its RTT, not just the winner.
+	fastestExplore = 64
+)
+
+var errNoUpstreams = errors.New("no upstreams")
+
+// upstreamClient wraps an upstream with its latency statistics.
+type upstreamClient struct {
+	UP.Upstream
+	group  string // upstreamGroup.name
+	label  string // conf.Upstream.Name
+	weight int
+
+	requests atomic.Uint64
+	errors   atomic.Uint64
+
+	mu   sync.Mutex
+	ewma time.Duration // zero until the first sample
+
+	down       atomic.Bool // ejected by the health check
+	stopHealth context.CancelFunc
+
+	bootstrap *bootstrapResolver // nil if the host is an IP or pinned
+}
+
+func (u *upstreamClient) observe(rtt time.Duration, err error) {
+	u.requests.Add(1)
+	metrics.UpstreamRequests.WithLabelValues(u.label).Inc()
+	if err != nil {
+		u.errors.Add(1)
+		metrics.UpstreamErrors.WithLabelValues(u.label).Inc()
+		rtt = errorPenalty
+	} else {
+		metrics.UpstreamLatency.WithLabelValues(u.label).Observe(rtt.Seconds())
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.ewma == 0 {
+		u.ewma = rtt
+		return
+	}
+	u.ewma = time.Duration(ewmaWeight*float64(rtt) + (1-ewmaWeight)*float64(u.ewma))
+}
+
+func (u *upstreamClient) latency() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.ewma
+}
+
+// Exchange sends req to the upstream and records the attempt, so every
+// request counts whichever policy sent it, the losers of a parallel
+// exchange included.
+func (u *upstreamClient) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := u.Upstream.Exchange(req)
+	u.observe(time.Since(start), err)
+	return resp, err
+}
+
+// selector implements options.policy.
+type selector struct {
+	policy conf.Policy
+	next   atomic.Uint64
+}
+
+// exchange resolves req through ups according to the policy and returns the
+// upstream that answered.
+func (s *selector) exchange(ups []*upstreamClient, req *dns.Msg) (*dns.Msg, *upstreamClient, error) {
+	ups = healthyUpstreams(ups)
+	if len(ups) == 0 {
+		return nil, nil, errNoUpstreams
+	}
+	switch s.policy {
+	case conf.PolicyFailover:
+		return exchangeInOrder(ups, req)
+	case conf.PolicyRoundRobin:
+		n := s.next.Add(1) - 1
+		return exchangeInOrder(rotate(ups, weighted(ups, int(n%uint64(totalWeight(ups))))), req)
+	case conf.PolicyRandom:
+		return exchangeInOrder(rotate(ups, weighted(ups, rand.IntN(totalWeight(ups)))), req)
+	case conf.PolicyFastest:
+		if s.next.Add(1)%fastestExplore == 0 {
+			return exchangeParallel(ups, req)
+		}
+		return exchangeInOrder(byLatency(ups), req)
+	default:
+		return exchangeParallel(ups, req)
+	}
+}
+
+// exchangeParallel is UP.ExchangeParallel. Each upstream records its own
+// attempt, the slower ones once they're done.
+func exchangeParallel(ups []*upstreamClient, req *dns.Msg) (*dns.Msg, *upstreamClient, error) {
+	list := make([]UP.Upstream, len(ups))
+	for i, u := range ups {
+		list[i] = u
+	}
+
+	resp, fastest, err := UP.ExchangeParallel(list, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp, fastest.(*upstreamClient), nil
+}
+
+// exchangeInOrder tries ups one after another until one of them answers.
+func exchangeInOrder(ups []*upstreamClient, req *dns.Msg) (*dns.Msg, *upstreamClient, error) {
+	var errs []error
+	for _, u := range ups {
+		resp, err := u.Exchange(req)
+		if err == nil {
+			return resp, u, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+func totalWeight(ups []*upstreamClient) int {
+	total := 0
+	for _, u := range ups {
+		total += u.weight
+	}
+	return total
+}
+
+// weighted maps n in [0, totalWeight) to an index of ups, each upstream
+// taking as many numbers as its weight.
+func weighted(ups []*upstreamClient, n int) int {
+	for i, u := range ups {
+		if n < u.weight {
+			return i
+		}
+		n -= u.weight
+	}
+	return 0
+}
+
+func rotate(ups []*upstreamClient, start int) []*upstreamClient {
+	out := make([]*upstreamClient, 0, len(ups))
+	out = append(out, ups[start:]...)
+	return append(out, ups[:start]...)
+}
+
+// byLatency orders ups by EWMA latency; unmeasured upstreams come first so
+// they get a sample.
+func byLatency(ups []*upstreamClient) []*upstreamClient {
+	type ranked struct {
+		u   *upstreamClient
+		rtt time.Duration
+	}
+	rs := make([]ranked, len(ups))
+	for i, u := range ups {
+		rs[i] = ranked{u, u.latency()}
+	}
+	slices.SortStableFunc(rs, func(a, b ranked) int {
+		return cmp.Compare(a.rtt, b.rtt)
+	})
+
+	out := make([]*upstreamClient, len(rs))
+	for i, r := range rs {
+		out[i] = r.u
+	}
+	return out
+}
@@ -0,0 +1,171 @@
+package core
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+// testUpstreams builds upstreams labeled a, b, c... from the given fakes.
+func testUpstreams(fakes ...*fakeUpstream) []*upstreamClient {
+	ups := make([]*upstreamClient, len(fakes))
+	for i, f := range fakes {
+		label := string(rune('a' + i))
+		f.addr = label
+		ups[i] = &upstreamClient{Upstream: f, group: "test", label: label, weight: 1}
+	}
+	return ups
+}
+
+func TestWeighted(t *testing.T) {
+	ups := testUpstreams(&fakeUpstream{}, &fakeUpstream{}, &fakeUpstream{})
+	ups[0].weight, ups[1].weight, ups[2].weight = 1, 3, 2
+	want := []int{0, 1, 1, 1, 2, 2}
+	if n := totalWeight(ups); n != len(want) {
+		t.Fatalf("totalWeight = %d, want %d", n, len(want))
+	}
+	for n, i := range want {
+		if got := weighted(ups, n); got != i {
+			t.Errorf("weighted(%d) = %d, want %d", n, got, i)
+		}
+	}
+}
+
+func TestSelectorExchange(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy conf.Policy
+		fakes  []*fakeUpstream
+		setup  func(ups []*upstreamClient)
+		want   []string // label that answers each query in turn, "" fails
+	}{
+		{
+			name:   "failover first",
+			policy: conf.PolicyFailover,
+			fakes:  []*fakeUpstream{{}, {}},
+			want:   []string{"a", "a", "a"},
+		},
+		{
+			name:   "failover next on error",
+			policy: conf.PolicyFailover,
+			fakes:  []*fakeUpstream{{err: errFake}, {}},
+			want:   []string{"b", "b"},
+		},
+		{
+			name:   "failover all fail",
+			policy: conf.PolicyFailover,
+			fakes:  []*fakeUpstream{{err: errFake}, {err: errFake}},
+			want:   []string{""},
+		},
+		{
+			name:   "round robin",
+			policy: conf.PolicyRoundRobin,
+			fakes:  []*fakeUpstream{{}, {}, {}},
+			want:   []string{"a", "b", "c", "a"},
+		},
+		{
+			name:   "round robin weighted",
+			policy: conf.PolicyRoundRobin,
+			fakes:  []*fakeUpstream{{}, {}},
+			setup:  func(ups []*upstreamClient) { ups[0].weight = 2 },
+			want:   []string{"a", "a", "b", "a", "a", "b"},
+		},
+		{
+			name:   "round robin skips errors",
+			policy: conf.PolicyRoundRobin,
+			fakes:  []*fakeUpstream{{}, {err: errFake}, {}},
+			want:   []string{"a", "c", "c", "a"},
+		},
+		{
+			name:   "round robin skips unhealthy",
+			policy: conf.PolicyRoundRobin,
+			fakes:  []*fakeUpstream{{}, {}, {}},
+			setup:  func(ups []*upstreamClient) { ups[1].down.Store(true) },
+			want:   []string{"a", "c", "a", "c"},
+		},
+		{
+			name:   "all unhealthy still tried",
+			policy: conf.PolicyFailover,
+			fakes:  []*fakeUpstream{{}, {}},
+			setup: func(ups []*upstreamClient) {
+				ups[0].down.Store(true)
+				ups[1].down.Store(true)
+			},
+			want: []string{"a"},
+		},
+		{
+			name:   "random falls through errors",
+			policy: conf.PolicyRandom,
+			fakes:  []*fakeUpstream{{err: errFake}, {err: errFake}, {}},
+			want:   []string{"c", "c", "c", "c"},
+		},
+		{
+			name:   "fastest",
+			policy: conf.PolicyFastest,
+			fakes:  []*fakeUpstream{{}, {}, {}},
+			setup: func(ups []*upstreamClient) {
+				ups[0].observe(30*time.Millisecond, nil)
+				ups[1].observe(10*time.Millisecond, nil)
+				ups[2].observe(20*time.Millisecond, nil)
+			},
+			want: []string{"b"},
+		},
+		{
+			name:   "fastest tries unmeasured first",
+			policy: conf.PolicyFastest,
+			fakes:  []*fakeUpstream{{}, {}},
+			setup:  func(ups []*upstreamClient) { ups[0].observe(10*time.Millisecond, nil) },
+			want:   []string{"b"},
+		},
+		{
+			name:   "parallel takes the fastest",
+			policy: conf.PolicyParallel,
+			fakes:  []*fakeUpstream{{delay: 200 * time.Millisecond}, {}},
+			want:   []string{"b"},
+		},
+		{
+			name:   "parallel all fail",
+			policy: conf.PolicyParallel,
+			fakes:  []*fakeUpstream{{err: errFake}, {err: errFake}},
+			want:   []string{""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ups := testUpstreams(tt.fakes...)
+			if tt.setup != nil {
+				tt.setup(ups)
+			}
+			s := &selector{policy: tt.policy}
+			for i, want := range tt.want {
+				req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+				resp, u, err := s.exchange(ups, req)
+				if want == "" {
+					if err == nil {
+						t.Errorf("query %d answered by %s, want an error", i, u.label)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("query %d: %v", i, err)
+				}
+				if u.label != want || resp.Id != req.Id {
+					t.Errorf("query %d answered by %s, want %s", i, u.label, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSelectorNoUpstreams(t *testing.T) {
+	for _, p := range []conf.Policy{conf.PolicyParallel, conf.PolicyFailover, conf.PolicyRoundRobin, conf.PolicyRandom, conf.PolicyFastest} {
+		s := &selector{policy: p}
+		if _, _, err := s.exchange(nil, new(dns.Msg).SetQuestion("example.com.", dns.TypeA)); !errors.Is(err, errNoUpstreams) {
+			t.Errorf("%s: err = %v, want %v", p, err, errNoUpstreams)
+		}
+	}
+}
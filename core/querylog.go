@@ -0,0 +1,317 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"df/conf"
+)
+
+const (
+	queryLogPrefix = "query-"
+	queryLogSuffix = ".jsonl"
+	queryLogDay    = "2006-01-02"
+	// queryLogBuffer bounds the records waiting to be written; when the disk
+	// can't keep up, records are dropped rather than slowing down queries.
+	queryLogBuffer = 4096
+)
+
+// queryLog appends QueryEvents to one JSONL file per day in dir, removing
+// the files older than retention days.
+type queryLog struct {
+	dir       string
+	retention int
+
+	mu      sync.RWMutex
+	closed  bool
+	ch      chan QueryEvent
+	done    chan struct{}
+	dropped atomic.Uint64
+}
+
+func newQueryLog(cfg conf.QueryLogConfig) (*queryLog, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("query log: %w", err)
+	}
+	l := &queryLog{
+		dir:       cfg.Dir,
+		retention: cfg.Retention,
+		ch:        make(chan QueryEvent, queryLogBuffer),
+		done:      make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *queryLog) record(e QueryEvent) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.ch <- e:
+	default:
+		l.dropped.Add(1)
+	}
+}
+
+// close writes the pending records and closes the file.
+func (l *queryLog) close() {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return
+	}
+	l.closed = true
+	close(l.ch)
+	l.mu.Unlock()
+	<-l.done
+}
+
+func (l *queryLog) run() {
+	defer close(l.done)
+
+	var (
+		f   *os.File
+		w   *bufio.Writer
+		day string
+	)
+	closeFile := func() {
+		if f == nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			slog.Error("query log: write", "err", err)
+		}
+		f.Close()
+		f = nil
+	}
+	defer closeFile()
+
+	lastCleanup := time.Now()
+	l.cleanup(lastCleanup)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case e, ok := <-l.ch:
+			if !ok {
+				return
+			}
+			if d := e.Time.Format(queryLogDay); d != day || f == nil {
+				closeFile()
+				var err error
+				f, err = os.OpenFile(l.path(d), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+				if err != nil {
+					slog.Error("query log: open", "err", err)
+					continue
+				}
+				w = bufio.NewWriter(f)
+				day = d
+			}
+			b, _ := json.Marshal(e)
+			w.Write(append(b, '\n'))
+
+		case now := <-ticker.C:
+			if f != nil {
+				if err := w.Flush(); err != nil {
+					slog.Error("query log: write", "err", err)
+				}
+			}
+			if n := l.dropped.Swap(0); n > 0 {
+				slog.Warn("query log: records dropped", "count", n)
+			}
+			if now.Sub(lastCleanup) >= time.Hour {
+				lastCleanup = now
+				l.cleanup(now)
+			}
+		}
+	}
+}
+
+func (l *queryLog) path(day string) string {
+	return filepath.Join(l.dir, queryLogPrefix+day+queryLogSuffix)
+}
+
+// cleanup removes the files that fell out of the retention period.
+func (l *queryLog) cleanup(now time.Time) {
+	oldest := now.AddDate(0, 0, -l.retention).Format(queryLogDay)
+	for _, day := range queryLogDays(l.dir) {
+		if day >= oldest {
+			break
+		}
+		if err := os.Remove(l.path(day)); err != nil {
+			slog.Warn("query log: remove old file", "err", err)
+		}
+	}
+}
+
+// queryLogDays lists the days dir has a query log file for, oldest first.
+func queryLogDays(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var days []string
+	for _, e := range entries {
+		day, ok := strings.CutPrefix(e.Name(), queryLogPrefix)
+		if !ok {
+			continue
+		}
+		day, ok = strings.CutSuffix(day, queryLogSuffix)
+		if !ok {
+			continue
+		}
+		if _, err := time.ParseInLocation(queryLogDay, day, time.Local); err == nil {
+			days = append(days, day)
+		}
+	}
+	slices.Sort(days)
+	return days
+}
+
+// QueryFilter selects query log records, zero fields match everything.
+type QueryFilter struct {
+	Client string    // client IP
+	Domain string    // part of the query name, case-insensitive
+	From   time.Time // inclusive
+	To     time.Time // exclusive
+	// Status is blocked, cached, local, error or a response code like
+	// NXDOMAIN.
+	Status string
+	Limit  int
+}
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 10000
+)
+
+func (f *QueryFilter) match(e *QueryEvent) bool {
+	if f.Client != "" && e.Client != f.Client {
+		return false
+	}
+	if f.Domain != "" && !strings.Contains(strings.ToLower(e.Name), strings.ToLower(f.Domain)) {
+		return false
+	}
+	if !f.From.IsZero() && e.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.Time.Before(f.To) {
+		return false
+	}
+	switch strings.ToLower(f.Status) {
+	case "":
+	case "blocked":
+		return e.Blocked
+	case "cached":
+		return e.Cached
+	case "local":
+		return e.Local
+	case "error":
+		return e.Error != ""
+	default:
+		return strings.EqualFold(e.Rcode, f.Status)
+	}
+	return true
+}
+
+func (f *QueryFilter) limit() int {
+	if f.Limit <= 0 {
+		return defaultQueryLimit
+	}
+	return min(f.Limit, maxQueryLimit)
+}
+
+// SearchQueries returns the records matching f, newest first. Without a
+// query log only the queries kept in memory are searched.
+func SearchQueries(f QueryFilter) ([]QueryEvent, error) {
+	st := current.Load()
+	if st.qlog != nil {
+		return ReadQueryLog(st.qlog.dir, f)
+	}
+
+	out := []QueryEvent{}
+	for _, e := range RecentQueries(recentQueries) {
+		if f.match(&e) {
+			out = append(out, e)
+			if len(out) == f.limit() {
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// ReadQueryLog searches the query log files in dir, newest first. Records
+// still buffered by a running server may be missing.
+func ReadQueryLog(dir string, f QueryFilter) ([]QueryEvent, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	limit := f.limit()
+
+	out := []QueryEvent{}
+	days := queryLogDays(dir)
+	for i := len(days) - 1; i >= 0 && len(out) < limit; i-- {
+		// files are per local day, allow a day of slack for time zones
+		day, _ := time.ParseInLocation(queryLogDay, days[i], time.Local)
+		if !f.From.IsZero() && day.AddDate(0, 0, 2).Before(f.From) {
+			break
+		}
+		if !f.To.IsZero() && day.AddDate(0, 0, -1).After(f.To) {
+			continue
+		}
+
+		matches, err := readQueryLogFile(filepath.Join(dir, queryLogPrefix+days[i]+queryLogSuffix), &f, limit-len(out))
+		if err != nil {
+			return out, err
+		}
+		for j := len(matches) - 1; j >= 0; j-- {
+			out = append(out, matches[j])
+		}
+	}
+	return out, nil
+}
+
+// readQueryLogFile returns the last n records of path matching f, oldest
+// first.
+func readQueryLogFile(path string, f *QueryFilter, n int) ([]QueryEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var matches []QueryEvent
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for sc.Scan() {
+		var e QueryEvent
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			// a line cut short by a crash
+			continue
+		}
+		if !f.match(&e) {
+			continue
+		}
+		matches = append(matches, e)
+		if len(matches) >= 2*n {
+			matches = append(matches[:0], matches[len(matches)-n:]...)
+		}
+	}
+	if len(matches) > n {
+		matches = matches[len(matches)-n:]
+	}
+	return matches, sc.Err()
+}
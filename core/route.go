@@ -0,0 +1,224 @@
+package core
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/netip"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"df/conf"
+	"df/metrics"
+
+	UP "github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// upstreamGroup is a set of upstreams sharing a policy. The top level
+// upstream list is the default group, routes send other domains elsewhere.
+type upstreamGroup struct {
+	name      string
+	cfg       conf.UpstreamGroup
+	upstreams []*upstreamClient
+	policy    *selector
+}
+
+// upstreamGroups builds the default and the named groups of cfg, taking over
+// the upstream connections of old where the group didn't change.
+func upstreamGroups(cfg *conf.Config, old *state) ([]*upstreamGroup, error) {
+	var groups []*upstreamGroup
+	names := append([]string{conf.DefaultGroup}, slices.Sorted(maps.Keys(cfg.UpstreamGroups))...)
+	for _, name := range names {
+		gc := cfg.UpstreamGroups[name]
+		if name == conf.DefaultGroup {
+			gc = conf.UpstreamGroup{
+				Upstream:  cfg.Upstream,
+				Policy:    cfg.Options.Policy,
+				Bootstrap: cfg.Options.Bootstrap,
+			}
+		}
+		g := &upstreamGroup{name: name, cfg: gc, policy: &selector{policy: gc.Policy}}
+		if og := old.group(name); og != nil && sameUpstreams(og.cfg, gc) && old.cfg.Options.HealthCheck == cfg.Options.HealthCheck {
+			g.upstreams = og.upstreams
+		} else {
+			ups, err := newUpstreams(name, gc, cfg.Options.HealthCheck)
+			if err != nil {
+				closeGroups(groups, old)
+				return nil, fmt.Errorf("upstream group %s: %w", name, err)
+			}
+			g.upstreams = ups
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func newUpstreams(group string, cfg conf.UpstreamGroup, health conf.HealthCheckOptions) ([]*upstreamClient, error) {
+	servers, err := bootstrapServers(cfg.Bootstrap)
+	if err != nil {
+		return nil, err
+	}
+
+	var ups []*upstreamClient
+	for _, uc := range cfg.Upstream {
+		u, err := newUpstream(uc, servers)
+		if err != nil {
+			for _, u := range ups {
+				u.Close()
+			}
+			return nil, fmt.Errorf("invalid upstream %s: %w", uc.Name(), err)
+		}
+		u.group = group
+		ups = append(ups, u)
+	}
+	for _, u := range ups {
+		u.startHealthCheck(health)
+	}
+	return ups, nil
+}
+
+// newUpstream builds the client of one upstream entry. Its host is resolved
+// through the bootstrap servers unless it's an IP or pinned to some.
+func newUpstream(uc conf.Upstream, servers []string) (*upstreamClient, error) {
+	uu, err := conf.UpstreamURL(uc.Address)
+	if err != nil {
+		return nil, err
+	}
+	host := uu.Hostname()
+
+	var resolver UP.Resolver
+	var bootstrap *bootstrapResolver
+	if len(uc.Addrs) > 0 {
+		resolver = &staticResolver{addrs: uc.Addrs}
+	} else if ip, err := netip.ParseAddr(host); err == nil {
+		resolver = &staticResolver{addrs: []netip.Addr{ip}}
+	} else {
+		bootstrap = newBootstrapResolver(servers)
+		resolver = bootstrap
+	}
+
+	if name := uc.TLS.ServerName; name != "" {
+		// the library verifies and sends as SNI the host of the url, so
+		// the server name takes its place and the resolver still looks up
+		// the real host
+		if port := uu.Port(); port != "" {
+			name = net.JoinHostPort(name, port)
+		}
+		uu.Host = name
+		resolver = renamedResolver{Resolver: resolver, host: host}
+	}
+
+	opts := &UP.Options{
+		Bootstrap:          resolver,
+		Timeout:            time.Duration(uc.Timeout * float64(time.Second)),
+		InsecureSkipVerify: uc.TLS.InsecureSkipVerify,
+	}
+	for _, v := range uc.HTTPVersions {
+		opts.HTTPVersions = append(opts.HTTPVersions, UP.HTTPVersion(v))
+	}
+
+	var up UP.Upstream
+	if uc.TLS.ClientCert != "" {
+		up, err = newClientCertUpstream(uu, uc, opts)
+	} else {
+		up, err = UP.AddressToUpstream(uu.String(), opts)
+	}
+	if err != nil {
+		if bootstrap != nil {
+			bootstrap.Close()
+		}
+		return nil, err
+	}
+	return &upstreamClient{Upstream: up, label: uc.Name(), weight: uc.Weight, bootstrap: bootstrap}, nil
+}
+
+func sameUpstreams(a, b conf.UpstreamGroup) bool {
+	return reflect.DeepEqual(a.Upstream, b.Upstream) && slices.Equal(a.Bootstrap, b.Bootstrap)
+}
+
+// closeGroups closes the upstreams of groups unless other still uses them.
+// Their health series go too, unless an upstream of other reports under the
+// same group and label.
+func closeGroups(groups []*upstreamGroup, other *state) {
+	type series struct{ group, label string }
+	keep := make(map[*upstreamClient]bool)
+	reported := make(map[series]bool)
+	if other != nil {
+		for _, g := range other.groups {
+			for _, u := range g.upstreams {
+				keep[u] = true
+				reported[series{u.group, u.label}] = true
+			}
+		}
+	}
+	for _, g := range groups {
+		for _, u := range g.upstreams {
+			if keep[u] {
+				continue
+			}
+			if err := u.Close(); err != nil {
+				slog.Warn("close upstream", "upstream", u.label, "err", err)
+			}
+			if !reported[series{u.group, u.label}] {
+				metrics.UpstreamHealthy.DeleteLabelValues(u.group, u.label)
+			}
+		}
+	}
+}
+
+// group returns the upstream group called name, st may be nil.
+func (st *state) group(name string) *upstreamGroup {
+	if st == nil {
+		return nil
+	}
+	for _, g := range st.groups {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// router picks the upstream group of a query by the longest matching route
+// suffix.
+type router struct {
+	suffixes map[string]*upstreamGroup
+	fallback *upstreamGroup
+}
+
+func newRouter(routes []conf.Route, groups []*upstreamGroup) *router {
+	byName := make(map[string]*upstreamGroup)
+	for _, g := range groups {
+		byName[g.name] = g
+	}
+
+	// conf.validate made sure every group exists
+	r := &router{suffixes: make(map[string]*upstreamGroup), fallback: byName[conf.DefaultGroup]}
+	for _, route := range routes {
+		for _, d := range route.DomainSuffix {
+			r.suffixes[conf.DomainSuffix(d)] = byName[route.Group]
+		}
+	}
+	return r
+}
+
+func (r *router) route(qname string) *upstreamGroup {
+	if len(r.suffixes) == 0 {
+		return r.fallback
+	}
+	name := normalizeDomain(qname)
+	for name != "" {
+		if g, ok := r.suffixes[name]; ok {
+			return g
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return r.fallback
+}
@@ -0,0 +1,103 @@
+package core
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"df/metrics"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeUpstream answers every query after delay, or fails if err is set.
+type fakeUpstream struct {
+	addr   string
+	delay  time.Duration
+	err    error
+	calls  atomic.Int32
+	closed atomic.Bool
+}
+
+func (f *fakeUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	f.calls.Add(1)
+	time.Sleep(f.delay)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return new(dns.Msg).SetReply(req), nil
+}
+
+func (f *fakeUpstream) Address() string { return f.addr }
+
+func (f *fakeUpstream) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+var errFake = errors.New("fake failure")
+
+func testClient(group, label string) *upstreamClient {
+	return &upstreamClient{Upstream: &fakeUpstream{addr: label}, group: group, label: label, weight: 1}
+}
+
+// healthSeries lists the group/upstream pairs of the health gauge.
+func healthSeries(t *testing.T) map[string]bool {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(metrics.UpstreamHealthy)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]bool)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var group, upstream string
+			for _, l := range m.GetLabel() {
+				switch l.GetName() {
+				case "group":
+					group = l.GetValue()
+				case "upstream":
+					upstream = l.GetValue()
+				}
+			}
+			out[group+"/"+upstream] = true
+		}
+	}
+	return out
+}
+
+func TestCloseGroupsHealthSeries(t *testing.T) {
+	metrics.UpstreamHealthy.Reset()
+	defer metrics.UpstreamHealthy.Reset()
+
+	oldA, oldB, shared := testClient("default", "a"), testClient("default", "b"), testClient("other", "c")
+	newA := testClient("default", "a")
+	for _, u := range []*upstreamClient{oldA, oldB, shared, newA} {
+		metrics.UpstreamHealthy.WithLabelValues(u.group, u.label).Set(1)
+	}
+	old := []*upstreamGroup{
+		{name: "default", upstreams: []*upstreamClient{oldA, oldB}},
+		{name: "other", upstreams: []*upstreamClient{shared}},
+	}
+	next := &state{groups: []*upstreamGroup{
+		{name: "default", upstreams: []*upstreamClient{newA}},
+		{name: "other", upstreams: []*upstreamClient{shared}},
+	}}
+
+	closeGroups(old, next)
+
+	for u, want := range map[*upstreamClient]bool{oldA: true, oldB: true, shared: false, newA: false} {
+		if got := u.Upstream.(*fakeUpstream).closed.Load(); got != want {
+			t.Errorf("%s/%s closed = %t, want %t", u.group, u.label, got, want)
+		}
+	}
+	got := healthSeries(t)
+	want := map[string]bool{"default/a": true, "other/c": true}
+	if len(got) != len(want) || !got["default/a"] || !got["other/c"] {
+		t.Errorf("health series = %v, want %v", got, want)
+	}
+}
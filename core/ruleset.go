@@ -0,0 +1,176 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+const ruleSetPollInterval = 10 * time.Second
+
+// loadRuleSet parses a rule list into s. Each line may be in one of:
+//
+//	0.0.0.0 ads.example.com      hosts file, exact match
+//	ads.example.com              domain list, suffix match, "*." optional
+//	||ads.example.com^           AdGuard/ABP, suffix match
+//	@@||good.example.com^        AdGuard/ABP exception
+//
+// Comments (#, !) and rules we can't express at the DNS level (cosmetic rules,
+// regexps, modifiers) are skipped.
+func (s *ruleSource) loadRuleSet(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 4096), 1024*1024)
+	for sc.Scan() {
+		s.addRule(sc.Text())
+	}
+	return sc.Err()
+}
+
+func (s *ruleSource) addRule(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+		return
+	}
+	// cosmetic rules
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") {
+		return
+	}
+
+	if rule, ok := strings.CutPrefix(line, "@@"); ok {
+		if d, ok := parseAdblockRule(rule); ok {
+			s.addException(d)
+		}
+		return
+	}
+	if strings.HasPrefix(line, "|") || strings.HasPrefix(line, "/") {
+		if d, ok := parseAdblockRule(line); ok {
+			s.addSuffix(d)
+		}
+		return
+	}
+
+	// hosts file and plain domain lists may carry trailing comments
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 1:
+		// a list entry covers the names below it anyway
+		if d, ok := validDomain(strings.TrimPrefix(fields[0], "*.")); ok {
+			s.addSuffix(d)
+		}
+	case len(fields) > 1:
+		if _, err := netip.ParseAddr(fields[0]); err != nil {
+			return
+		}
+		for _, name := range fields[1:] {
+			if isLocalHostname(name) {
+				continue
+			}
+			if d, ok := validDomain(name); ok {
+				s.addDomain(d)
+			}
+		}
+	}
+}
+
+// parseAdblockRule accepts only `||domain^` (optionally followed by `|`).
+func parseAdblockRule(rule string) (string, bool) {
+	rule, ok := strings.CutPrefix(rule, "||")
+	if !ok || strings.ContainsAny(rule, "$*/") {
+		return "", false
+	}
+	rule = strings.TrimSuffix(rule, "|")
+	rule = strings.TrimSuffix(rule, "^")
+	return validDomain(rule)
+}
+
+func validDomain(s string) (string, bool) {
+	d := normalizeDomain(s)
+	if d == "" {
+		return "", false
+	}
+	if _, ok := dns.IsDomainName(d); !ok {
+		return "", false
+	}
+	return d, true
+}
+
+func isLocalHostname(name string) bool {
+	switch strings.ToLower(name) {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost",
+		"ip6-localhost", "ip6-loopback", "ip6-localnet", "ip6-mcastprefix",
+		"ip6-allnodes", "ip6-allrouters", "ip6-allhosts", "0.0.0.0":
+		return true
+	}
+	return false
+}
+
+// watchRuleSets rebuilds the blocker in dst whenever one of the rule set files
+// changes on disk, until ctx is done. The old blocker keeps serving until the
+// new one is ready.
+func watchRuleSets(ctx context.Context, scope string, cfg conf.BlockConfig, dst *atomic.Pointer[blocker]) {
+	if len(cfg.RuleSet) == 0 {
+		return
+	}
+
+	last := ruleSetStamps(cfg.RuleSet)
+	ticker := time.NewTicker(ruleSetPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cur := ruleSetStamps(cfg.RuleSet)
+		if cur == last {
+			continue
+		}
+
+		b, err := newBlocker(scope, cfg)
+		if err != nil {
+			slog.Error("reload rule sets", "err", err)
+			continue
+		}
+		last = cur
+		dst.Store(b)
+		slog.Info("rule sets reloaded")
+	}
+}
+
+// ruleSetStamps fingerprints the rule set files by size and mtime.
+func ruleSetStamps(sets []string) string {
+	var sb strings.Builder
+	for _, s := range sets {
+		path, err := conf.FilePath(s)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			sb.WriteString("-;")
+			continue
+		}
+		fmt.Fprintf(&sb, "%d:%d;", fi.Size(), fi.ModTime().UnixNano())
+	}
+	return sb.String()
+}
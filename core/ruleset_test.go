@@ -0,0 +1,104 @@
+package core
+
+import "testing"
+
+func TestParseAdblockRule(t *testing.T) {
+	tests := []struct {
+		rule   string
+		want   string
+		wantOK bool
+	}{
+		{"||ads.example.com^", "ads.example.com", true},
+		{"||ads.example.com^|", "ads.example.com", true},
+		{"||ads.example.com", "ads.example.com", true},
+		{"||Ads.Example.COM^", "ads.example.com", true},
+		{"||ads.example.com.^", "ads.example.com", true},
+		{"|ads.example.com^", "", false},
+		{"ads.example.com", "", false},
+		{"||ads.example.com^$important", "", false},
+		{"||ads.example.com^$client=192.0.2.1", "", false},
+		{"||*.example.com^", "", false},
+		{"||example.com/ads^", "", false},
+		{"/ads[0-9]+\\.example\\.com/", "", false},
+		{"||^", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := parseAdblockRule(tt.rule)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseAdblockRule(%q) = %q, %t, want %q, %t", tt.rule, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestAddRule(t *testing.T) {
+	// kind is where the rule lands: domain, suffix, exception or nowhere ""
+	tests := []struct {
+		line   string
+		kind   string
+		domain string
+	}{
+		{"ads.example.com", "suffix", "ads.example.com"},
+		{"  Ads.Example.com.  ", "suffix", "ads.example.com"},
+		{"ads.example.com # tracker", "suffix", "ads.example.com"},
+		{"0.0.0.0 ads.example.com", "domain", "ads.example.com"},
+		{"127.0.0.1 ads.example.com # tracker", "domain", "ads.example.com"},
+		{":: ads.example.com", "domain", "ads.example.com"},
+		{"||ads.example.com^", "suffix", "ads.example.com"},
+		{"@@||good.example.com^", "exception", "good.example.com"},
+		{"@@good.example.com", "", ""},
+		{"||ads.example.com^$third-party", "", ""},
+		{"/banner/", "", ""},
+		{"example.com##.banner", "", ""},
+		{"example.com#@#.banner", "", ""},
+		{"example.com#?#.banner:has(a)", "", ""},
+		{"! comment", "", ""},
+		{"# comment", "", ""},
+		{"[Adblock Plus 2.0]", "", ""},
+		{"127.0.0.1 localhost", "", ""},
+		{"not-an-ip ads.example.com", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		s := newRuleSource("test")
+		s.addRule(tt.line)
+
+		kind := ""
+		switch {
+		case s.rules == 0:
+		case s.rules > 1:
+			t.Errorf("addRule(%q) added %d rules, want 1", tt.line, s.rules)
+			continue
+		case len(s.domains) == 1:
+			kind = "domain"
+			if _, ok := s.domains[tt.domain]; !ok {
+				t.Errorf("addRule(%q) domains = %v, want %q", tt.line, s.domains, tt.domain)
+			}
+		case s.suffixes.match(tt.domain):
+			kind = "suffix"
+		case s.allow.match(tt.domain):
+			kind = "exception"
+		default:
+			kind = "other"
+		}
+		if kind != tt.kind {
+			t.Errorf("addRule(%q) added a %q rule, want %q", tt.line, kind, tt.kind)
+		}
+	}
+}
+
+func TestAddRuleHostsLine(t *testing.T) {
+	s := newRuleSource("test")
+	s.addRule("0.0.0.0 ads.example.com tracker.example.com localhost")
+	if s.rules != 2 {
+		t.Fatalf("rules = %d, want 2", s.rules)
+	}
+	for _, d := range []string{"ads.example.com", "tracker.example.com"} {
+		if _, ok := s.domains[d]; !ok {
+			t.Errorf("%s missing from domains %v", d, s.domains)
+		}
+	}
+	// hosts entries are exact, unlike domain lists
+	if s.suffixes.match("sub.ads.example.com") {
+		t.Error("hosts entry matched a subdomain")
+	}
+}
@@ -0,0 +1,224 @@
+package core
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	recentQueries = 500
+	// topKeys bounds the top-N counters; when it's exceeded all counts are
+	// halved and the ones dropping to zero are forgotten.
+	topKeys = 10000
+)
+
+// QueryEvent describes one query handled by Core.
+type QueryEvent struct {
+	Time      time.Time     `json:"time"`
+	Client    string        `json:"client"`
+	Proto     string        `json:"proto,omitempty"`
+	User      string        `json:"user,omitempty"`
+	Name      string        `json:"name"`
+	Type      string        `json:"type"`
+	Rcode     string        `json:"rcode"`
+	Upstream  string        `json:"upstream,omitempty"`
+	Latency   time.Duration `json:"latency"`
+	Cached    bool          `json:"cached"`
+	Local     bool          `json:"local,omitempty"` // answered from the hosts section
+	Blocked   bool          `json:"blocked"`
+	BlockedBy string        `json:"blocked_by,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Count is a key and how often it was seen.
+type Count struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// UpstreamStat is a snapshot of the statistics of one upstream.
+type UpstreamStat struct {
+	Group    string        `json:"group"`
+	Label    string        `json:"label"`
+	Address  string        `json:"address"`
+	Requests uint64        `json:"requests"`
+	Errors   uint64        `json:"errors"`
+	Latency  time.Duration `json:"latency"` // EWMA
+	Healthy  bool          `json:"healthy"`
+}
+
+// RuleSource describes one switchable group of block rules.
+type RuleSource struct {
+	Name    string `json:"name"`
+	Rules   int    `json:"rules"`
+	Enabled bool   `json:"enabled"`
+}
+
+type recorder struct {
+	mu      sync.Mutex
+	recent  []QueryEvent // ring buffer
+	next    int
+	blocked map[string]uint64
+	clients map[string]uint64
+}
+
+var (
+	stats = &recorder{
+		recent:  make([]QueryEvent, 0, recentQueries),
+		blocked: make(map[string]uint64),
+		clients: make(map[string]uint64),
+	}
+
+	// disabledSources holds the switched off rule sources by blocker scope
+	// and source name, the same names recur in the DoH users' blockers.
+	disabledSources atomic.Pointer[map[string]map[string]bool]
+	disabledMu      sync.Mutex
+)
+
+func init() {
+	disabledSources.Store(&map[string]map[string]bool{})
+}
+
+func (r *recorder) record(e QueryEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.recent) < recentQueries {
+		r.recent = append(r.recent, e)
+	} else {
+		r.recent[r.next] = e
+	}
+	r.next = (r.next + 1) % recentQueries
+
+	countKey(r.clients, e.Client)
+	if e.Blocked {
+		countKey(r.blocked, e.Name)
+	}
+}
+
+func countKey(m map[string]uint64, key string) {
+	m[key]++
+	if len(m) <= topKeys {
+		return
+	}
+	for k, v := range m {
+		if v /= 2; v == 0 {
+			delete(m, k)
+		} else {
+			m[k] = v
+		}
+	}
+}
+
+// RecentQueries returns up to n of the latest queries, newest first.
+func RecentQueries(n int) []QueryEvent {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	n = min(n, len(stats.recent))
+	out := make([]QueryEvent, 0, n)
+	for i := 1; i <= n; i++ {
+		idx := (stats.next - i + len(stats.recent)) % len(stats.recent)
+		out = append(out, stats.recent[idx])
+	}
+	return out
+}
+
+// TopBlocked returns the n most blocked domains.
+func TopBlocked(n int) []Count {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return top(stats.blocked, n)
+}
+
+// TopClients returns the n clients sending the most queries.
+func TopClients(n int) []Count {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	return top(stats.clients, n)
+}
+
+func top(m map[string]uint64, n int) []Count {
+	out := make([]Count, 0, len(m))
+	for k, v := range m {
+		out = append(out, Count{Key: k, Count: v})
+	}
+	slices.SortFunc(out, func(a, b Count) int {
+		if c := cmp.Compare(b.Count, a.Count); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Key, b.Key)
+	})
+	return out[:min(n, len(out))]
+}
+
+// UpstreamStats returns the statistics of every upstream.
+func UpstreamStats() []UpstreamStat {
+	var out []UpstreamStat
+	for _, g := range current.Load().groups {
+		for _, u := range g.upstreams {
+			out = append(out, UpstreamStat{
+				Group:    g.name,
+				Label:    u.label,
+				Address:  u.Address(),
+				Requests: u.requests.Load(),
+				Errors:   u.errors.Load(),
+				Latency:  u.latency(),
+				Healthy:  u.healthy(),
+			})
+		}
+	}
+	return out
+}
+
+// RuleSources lists the rule sources of the global block section.
+func RuleSources() []RuleSource {
+	bl := current.Load().block.Load()
+	disabled := bl.disabled()
+
+	out := make([]RuleSource, 0, len(bl.sources))
+	for _, src := range bl.sources {
+		out = append(out, RuleSource{
+			Name:    src.name,
+			Rules:   src.rules,
+			Enabled: !disabled[src.name],
+		})
+	}
+	return out
+}
+
+// SetRuleSource switches a rule source of the global block section on or
+// off. It survives rule set reloads but not a restart.
+func SetRuleSource(name string, enabled bool) {
+	disabledMu.Lock()
+	defer disabledMu.Unlock()
+
+	m := maps.Clone(*disabledSources.Load())
+	names := maps.Clone(m[""])
+	if names == nil {
+		names = make(map[string]bool)
+	}
+	if enabled {
+		delete(names, name)
+	} else {
+		names[name] = true
+	}
+	m[""] = names
+	disabledSources.Store(&m)
+}
+
+// disabled returns the switched off sources of b by name.
+func (b *blocker) disabled() map[string]bool {
+	return (*disabledSources.Load())[b.scope]
+}
+
+// FlushCache drops every cached response.
+func FlushCache() {
+	if c := current.Load().cache; c != nil {
+		c.flush()
+	}
+}
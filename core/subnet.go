@@ -0,0 +1,172 @@
+package core
+
+import (
+	"net"
+	"net/netip"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+// ecsUDPSize is advertised when we have to add an OPT record ourselves.
+const ecsUDPSize = 1232
+
+// subnet injects EDNS Client Subnet (RFC 7871) into upstream queries.
+type subnet struct {
+	fixed      netip.Prefix // valid unless deriving from the client
+	fromClient bool
+	v4Bits     int
+	v6Bits     int
+	policy     string
+}
+
+func newSubnet(cfg conf.ECSOptions) *subnet {
+	s := &subnet{
+		fromClient: cfg.Subnet == conf.ECSClient,
+		v4Bits:     cfg.IPv4Prefix,
+		v6Bits:     cfg.IPv6Prefix,
+		policy:     cfg.Policy,
+	}
+	if !s.fromClient {
+		s.fixed = cfg.Fixed
+	}
+	return s
+}
+
+// prefix returns the subnet to send for client, if any.
+func (s *subnet) prefix(client netip.Addr) (netip.Prefix, bool) {
+	if !s.fromClient {
+		return s.fixed, s.fixed.IsValid()
+	}
+	// private and loopback addresses mean nothing to an authoritative server
+	if !client.IsValid() || !client.IsGlobalUnicast() || client.IsPrivate() {
+		return netip.Prefix{}, false
+	}
+	bits := s.v6Bits
+	if client.Is4() {
+		bits = s.v4Bits
+	}
+	p, err := client.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return p, true
+}
+
+// apply returns the query to send upstream. req itself is never modified;
+// the returned message is a copy whenever its OPT record differs.
+func (s *subnet) apply(req *dns.Msg, client netip.Addr) *dns.Msg {
+	clientECS := findECS(req)
+	if clientECS != nil && s.policy == conf.ECSKeep {
+		return req
+	}
+
+	p, ok := s.prefix(client)
+	if s.policy == conf.ECSRemove && clientECS != nil {
+		// the client's ECS goes, and ours doesn't take its place
+		ok = false
+	}
+	if !ok && clientECS == nil {
+		return req
+	}
+
+	out := req.Copy()
+	opt := out.IsEdns0()
+	if opt == nil {
+		out.SetEdns0(ecsUDPSize, false)
+		opt = out.IsEdns0()
+	}
+	removeECS(opt)
+	if ok {
+		opt.Option = append(opt.Option, ecsOption(p))
+	}
+	return out
+}
+
+// restore makes the ECS part of resp match what the client sent, so our own
+// subnet never leaks back and an OPT record only appears if the client had one.
+func (s *subnet) restore(req, resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	if req.IsEdns0() == nil {
+		removeOPT(resp)
+		return
+	}
+
+	upECS := findECS(resp)
+	removeECS(opt)
+	if clientECS := findECS(req); clientECS != nil {
+		echo := *clientECS
+		if upECS != nil {
+			echo.SourceScope = upECS.SourceScope
+		}
+		opt.Option = append(opt.Option, &echo)
+	}
+}
+
+// ecsCacheKey returns the ECS part of the cache key for an upstream query.
+func ecsCacheKey(out *dns.Msg) string {
+	e := findECS(out)
+	if e == nil {
+		return ""
+	}
+	addr, ok := netip.AddrFromSlice(e.Address)
+	if !ok {
+		return ""
+	}
+	p, err := addr.Unmap().Prefix(int(e.SourceNetmask))
+	if err != nil {
+		return ""
+	}
+	return p.String()
+}
+
+func ecsOption(p netip.Prefix) *dns.EDNS0_SUBNET {
+	e := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(p.Bits()),
+		Address:       net.IP(p.Addr().AsSlice()),
+	}
+	if p.Addr().Is4() {
+		e.Family = 1
+	} else {
+		e.Family = 2
+	}
+	return e
+}
+
+func findECS(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func removeECS(opt *dns.OPT) {
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+func removeOPT(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
@@ -0,0 +1,119 @@
+package core
+
+import (
+	"net/netip"
+	"testing"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+// testQuery is an A query, with an OPT record carrying ecs unless ecs is ""
+// and an OPT record at all only if edns is set.
+func testQuery(edns bool, ecs string) *dns.Msg {
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	if edns || ecs != "" {
+		req.SetEdns0(1232, false)
+	}
+	if ecs != "" {
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, ecsOption(netip.MustParsePrefix(ecs)))
+	}
+	return req
+}
+
+// ecsString is the ECS of msg as a prefix, "" without one.
+func ecsString(msg *dns.Msg) string {
+	if findECS(msg) == nil {
+		return ""
+	}
+	return ecsCacheKey(msg)
+}
+
+func TestSubnetApply(t *testing.T) {
+	fixed := conf.ECSOptions{Fixed: netip.MustParsePrefix("198.51.100.0/24"), IPv4Prefix: 24, IPv6Prefix: 56}
+	client := conf.ECSOptions{Subnet: conf.ECSClient, IPv4Prefix: 24, IPv6Prefix: 56}
+	tests := []struct {
+		name      string
+		cfg       conf.ECSOptions
+		policy    string
+		client    string
+		clientECS string
+		want      string
+	}{
+		{name: "fixed", cfg: fixed, policy: conf.ECSKeep, client: "203.0.113.9", want: "198.51.100.0/24"},
+		{name: "fixed keeps client", cfg: fixed, policy: conf.ECSKeep, client: "203.0.113.9", clientECS: "192.0.2.0/24", want: "192.0.2.0/24"},
+		{name: "fixed replaces client", cfg: fixed, policy: conf.ECSReplace, client: "203.0.113.9", clientECS: "192.0.2.0/24", want: "198.51.100.0/24"},
+		{name: "fixed removes client", cfg: fixed, policy: conf.ECSRemove, client: "203.0.113.9", clientECS: "192.0.2.0/24"},
+		{name: "remove adds ours without client ecs", cfg: fixed, policy: conf.ECSRemove, client: "203.0.113.9", want: "198.51.100.0/24"},
+		{name: "from client v4", cfg: client, policy: conf.ECSKeep, client: "203.0.113.9", want: "203.0.113.0/24"},
+		{name: "from client v6", cfg: client, policy: conf.ECSKeep, client: "2001:4860::1", want: "2001:4860::/56"},
+		{name: "private client", cfg: client, policy: conf.ECSKeep, client: "10.1.2.3"},
+		{name: "loopback client", cfg: client, policy: conf.ECSKeep, client: "127.0.0.1"},
+		{name: "no client address", cfg: client, policy: conf.ECSKeep},
+		{name: "private client replaces", cfg: client, policy: conf.ECSReplace, client: "10.1.2.3", clientECS: "192.0.2.0/24"},
+		{name: "disabled", policy: conf.ECSKeep, client: "203.0.113.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Policy = tt.policy
+			s := newSubnet(cfg)
+			var addr netip.Addr
+			if tt.client != "" {
+				addr = netip.MustParseAddr(tt.client)
+			}
+			req := testQuery(false, tt.clientECS)
+			out := s.apply(req, addr)
+			if got := ecsString(out); got != tt.want {
+				t.Errorf("ecs = %q, want %q", got, tt.want)
+			}
+			if got := ecsString(req); got != tt.clientECS {
+				t.Errorf("apply changed the request ecs to %q", got)
+			}
+			if out == req && ecsString(out) != tt.clientECS {
+				t.Error("apply changed the request instead of a copy")
+			}
+		})
+	}
+}
+
+func TestSubnetRestore(t *testing.T) {
+	tests := []struct {
+		name      string
+		edns      bool
+		clientECS string
+		upECS     string
+		wantOPT   bool
+		wantECS   string
+	}{
+		{name: "no edns from client", upECS: "198.51.100.0/24"},
+		{name: "ours stripped", edns: true, upECS: "198.51.100.0/24", wantOPT: true},
+		{name: "client echoed", edns: true, clientECS: "192.0.2.0/24", upECS: "198.51.100.0/24", wantOPT: true, wantECS: "192.0.2.0/24"},
+		{name: "client echoed without upstream ecs", edns: true, clientECS: "192.0.2.0/24", wantOPT: true, wantECS: "192.0.2.0/24"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := testQuery(tt.edns, tt.clientECS)
+			up := testQuery(true, tt.upECS)
+			resp := new(dns.Msg).SetReply(up)
+			resp.Extra = up.Extra
+			if tt.upECS != "" {
+				findECS(resp).SourceScope = 20
+			}
+
+			new(subnet).restore(req, resp)
+
+			if got := resp.IsEdns0() != nil; got != tt.wantOPT {
+				t.Fatalf("OPT = %t, want %t", got, tt.wantOPT)
+			}
+			if got := ecsString(resp); got != tt.wantECS {
+				t.Errorf("ecs = %q, want %q", got, tt.wantECS)
+			}
+			if e := findECS(resp); e != nil && tt.upECS != "" && e.SourceScope != 20 {
+				t.Errorf("scope = %d, want the upstream's", e.SourceScope)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package core
+
+import (
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+// rewriteTTL applies options.ttl to every record of resp except OPT.
+// Overwrite wins over Min/Max, a zero value disables the respective setting.
+func rewriteTTL(resp *dns.Msg, opts conf.TTLOptions) {
+	if opts.Overwrite == 0 && opts.Min == 0 && opts.Max == 0 {
+		return
+	}
+
+	forEachRR(resp, func(rr dns.RR) {
+		h := rr.Header()
+		switch {
+		case opts.Overwrite > 0:
+			h.Ttl = uint32(opts.Overwrite)
+		case opts.Min > 0 && h.Ttl < uint32(opts.Min):
+			h.Ttl = uint32(opts.Min)
+		case opts.Max > 0 && h.Ttl > uint32(opts.Max):
+			h.Ttl = uint32(opts.Max)
+		}
+	})
+}
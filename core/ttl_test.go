@@ -0,0 +1,52 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+func TestRewriteTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		opts conf.TTLOptions
+		ttl  uint32
+		want uint32
+	}{
+		{name: "off", ttl: 5, want: 5},
+		{name: "below min", opts: conf.TTLOptions{Min: 60}, ttl: 5, want: 60},
+		{name: "above min", opts: conf.TTLOptions{Min: 60}, ttl: 300, want: 300},
+		{name: "above max", opts: conf.TTLOptions{Max: 3600}, ttl: 86400, want: 3600},
+		{name: "below max", opts: conf.TTLOptions{Max: 3600}, ttl: 300, want: 300},
+		{name: "within min and max", opts: conf.TTLOptions{Min: 60, Max: 3600}, ttl: 300, want: 300},
+		{name: "zero ttl", opts: conf.TTLOptions{Min: 60, Max: 3600}, ttl: 0, want: 60},
+		{name: "overwrite wins", opts: conf.TTLOptions{Min: 60, Max: 3600, Overwrite: 10}, ttl: 300, want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+			resp.Answer = []dns.RR{testRR(t, fmt.Sprintf("example.com. %d IN A 192.0.2.1", tt.ttl))}
+			resp.Ns = []dns.RR{testRR(t, fmt.Sprintf("example.com. %d IN NS ns.example.com.", tt.ttl))}
+			resp.Extra = []dns.RR{testRR(t, fmt.Sprintf("ns.example.com. %d IN A 192.0.2.53", tt.ttl))}
+			resp.SetEdns0(1232, true)
+
+			rewriteTTL(resp, tt.opts)
+
+			for _, rr := range append(append(resp.Answer, resp.Ns...), resp.Extra...) {
+				if rr.Header().Rrtype == dns.TypeOPT {
+					// the OPT TTL holds the extended rcode and flags
+					if !rr.(*dns.OPT).Do() {
+						t.Error("OPT record was rewritten")
+					}
+					continue
+				}
+				if rr.Header().Ttl != tt.want {
+					t.Errorf("%s ttl = %d, want %d", dns.TypeToString[rr.Header().Rrtype], rr.Header().Ttl, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"df/conf"
+
+	"github.com/miekg/dns"
+)
+
+// userPolicy holds the per-user settings of an authenticated DoH user.
+type userPolicy struct {
+	qtypes map[uint16]struct{} // nil allows every type
+	block  atomic.Pointer[blocker]
+}
+
+func newUserPolicies(ctx context.Context, auths []conf.AuthDohItem) (map[string]*userPolicy, error) {
+	policies := make(map[string]*userPolicy, len(auths))
+	for _, a := range auths {
+		p := &userPolicy{}
+		if len(a.Types) > 0 {
+			p.qtypes = make(map[uint16]struct{}, len(a.Types))
+			for _, t := range a.Types {
+				p.qtypes[t] = struct{}{}
+			}
+		}
+
+		scope := "user:" + a.User
+		bl, err := newBlocker(scope, a.Block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid block config for doh user %s: %w", a.User, err)
+		}
+		p.block.Store(bl)
+		go watchRuleSets(ctx, scope, a.Block, &p.block)
+
+		policies[a.User] = p
+	}
+	return policies, nil
+}
+
+// check returns a response if the user is not allowed to send req. blockedBy
+// names the rule source if a block rule matched.
+func (p *userPolicy) check(req *dns.Msg, client Client) (resp *dns.Msg, blockedBy string) {
+	if len(req.Question) != 1 {
+		return nil, ""
+	}
+	q := req.Question[0]
+
+	if p.qtypes != nil {
+		if _, ok := p.qtypes[q.Qtype]; !ok {
+			return new(dns.Msg).SetRcode(req, dns.RcodeRefused), ""
+		}
+	}
+	bl := p.block.Load()
+	if src, ok := bl.match(q.Name, client.Addr); ok {
+		return bl.reply(req), bl.scope + ":" + src
+	}
+	return nil, ""
+}
@@ -0,0 +1,173 @@
+package df
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"df/conf"
+	"df/core"
+	"df/logger"
+	"df/server"
+)
+
+// listener is one protocol server. key fingerprints the config it was started
+// with, it's restarted on reload only if key changes.
+type listener struct {
+	name string
+	key  string
+	run  func(ctx context.Context) error
+}
+
+func listeners(cfg *conf.Config) []listener {
+	key := func(v ...any) string {
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+
+	ls := []listener{{
+		name: "standard",
+		key:  key(cfg.Server.Standard, cfg.Server.UDP, cfg.Server.Limits("udp"), cfg.Server.Limits("tcp"), cfg.Server.Access("udp"), cfg.Server.Access("tcp")),
+		run: func(ctx context.Context) error {
+			return server.Standard(ctx, cfg.Server.Standard)
+		},
+	}, {
+		name: "panel",
+		key:  key(cfg.Panel),
+		run: func(ctx context.Context) error {
+			return server.Panel(ctx, cfg.Panel.Port)
+		},
+	}}
+	if len(cfg.Server.Dot) > 0 {
+		ls = append(ls, listener{name: "dot", key: key(cfg.Server.Dot, cfg.TLS, cfg.Server.Limits("dot"), cfg.Server.Access("dot")), run: server.Dot})
+	}
+	if len(cfg.Server.Doq) > 0 {
+		ls = append(ls, listener{name: "doq", key: key(cfg.Server.Doq, cfg.TLS, cfg.Server.Limits("doq"), cfg.Server.Access("doq")), run: server.Doq})
+	}
+	if len(cfg.Server.Doh.Listen) > 0 {
+		ls = append(ls, listener{name: "doh", key: key(cfg.Server.Doh, cfg.TLS, cfg.Server.Limits("doh"), cfg.Server.Access("doh")), run: server.Doh})
+	}
+	if cfg.Metrics.Port != 0 {
+		ls = append(ls, listener{
+			name: "metrics",
+			key:  key(cfg.Metrics),
+			run: func(ctx context.Context) error {
+				return server.Metrics(ctx, cfg.Metrics.Port)
+			},
+		})
+	}
+	if len(cfg.Server.HTTP.Listen) > 0 {
+		ls = append(ls, listener{name: "http", key: key(cfg.Server.HTTP, cfg.Server.Limits("http"), cfg.Server.Access("http")), run: server.Http})
+	}
+	return ls
+}
+
+type runningListener struct {
+	key    string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (r *runningListener) stop() {
+	r.cancel()
+	<-r.done
+}
+
+func (r *runningListener) exited() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// supervisor keeps the set of running listeners in line with the config.
+type supervisor struct {
+	mu      sync.Mutex
+	running map[string]*runningListener
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{running: make(map[string]*runningListener)}
+}
+
+// apply starts new listeners, restarts the ones whose config changed and
+// stops the ones that are gone. Unchanged listeners keep their connections.
+func (s *supervisor) apply(cfg *conf.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, l := range listeners(cfg) {
+		seen[l.name] = true
+		if r, ok := s.running[l.name]; ok {
+			if r.key == l.key && !r.exited() {
+				continue
+			}
+			slog.Info("restarting listener", "listener", l.name)
+			r.stop()
+		}
+		s.running[l.name] = startListener(l)
+	}
+
+	for name, r := range s.running {
+		if !seen[name] {
+			slog.Info("stopping listener", "listener", name)
+			r.stop()
+			delete(s.running, name)
+		}
+	}
+}
+
+func startListener(l listener) *runningListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &runningListener{key: l.key, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		if err := l.run(ctx); err != nil {
+			slog.Error("listener failed", "listener", l.name, "err", err)
+		}
+	}()
+	return r
+}
+
+// reload re-reads the config and applies it to the core and the listeners.
+func reload(s *supervisor) error {
+	cfg, err := conf.Reload(func(cfg *conf.Config) error {
+		if err := core.Reload(cfg); err != nil {
+			return err
+		}
+		// the core already runs on cfg, so a log file that can't be opened
+		// keeps the old logger rather than rejecting the reload
+		if err := logger.Setup(cfg.Log); err != nil {
+			slog.Error("reload logger, keeping the old one", "err", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("reload config: %w", err)
+	}
+	s.apply(cfg)
+	return nil
+}
+
+// stopAll stops every running listener concurrently and waits until they
+// have drained.
+func (s *supervisor) stopAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for key, l := range s.running {
+		delete(s.running, key)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.stop()
+		}()
+	}
+	wg.Wait()
+}
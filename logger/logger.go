@@ -0,0 +1,83 @@
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"df/conf"
+)
+
+var (
+	level slog.LevelVar
+
+	mu   sync.Mutex
+	file *rotatingFile // nil while logging to stderr
+)
+
+// Setup makes slog's default logger follow cfg. It may be called again on
+// reload, an unchanged log file is kept open.
+func Setup(cfg conf.LogConfig) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var out io.Writer = os.Stderr
+	if cfg.File != "" {
+		if file == nil || file.path != cfg.File {
+			f, err := openRotatingFile(cfg.File)
+			if err != nil {
+				return fmt.Errorf("open log file: %w", err)
+			}
+			if file != nil {
+				file.Close()
+			}
+			file = f
+		}
+		file.setLimits(int64(cfg.MaxSize)*1024*1024, cfg.MaxBackups)
+		out = file
+	} else if file != nil {
+		file.Close()
+		file = nil
+	}
+
+	level.Set(parseLevel(cfg.Level))
+	opts := &slog.HandlerOptions{Level: &level}
+
+	var h slog.Handler
+	if cfg.Format == conf.LogJSON {
+		h = slog.NewJSONHandler(out, opts)
+	} else {
+		h = slog.NewTextHandler(out, opts)
+	}
+	// also catches log.Printf from the libraries we use
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+func parseLevel(s string) slog.Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// Close flushes and closes the log file, if any. Later records go to stderr.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if file != nil {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: &level})))
+		file.Close()
+		file = nil
+	}
+}
@@ -0,0 +1,105 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is an append-only file that's renamed to path.1 once it would
+// grow beyond maxSize; older backups shift up to path.<maxBackups>, anything
+// beyond is removed.
+type rotatingFile struct {
+	path string
+
+	mu         sync.Mutex
+	f          *os.File
+	size       int64
+	maxSize    int64
+	maxBackups int
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	r := &rotatingFile{path: path}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) setLimits(maxSize int64, maxBackups int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxSize = maxSize
+	r.maxBackups = maxBackups
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// keep logging into the current file rather than losing records
+			fmt.Fprintf(os.Stderr, "rotate log file %s: %v\n", r.path, err)
+		}
+		if r.f == nil {
+			return 0, os.ErrClosed
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+
+	backup := func(i int) string { return fmt.Sprintf("%s.%d", r.path, i) }
+	os.Remove(backup(r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		os.Rename(backup(i), backup(i+1))
+	}
+	if r.maxBackups > 0 {
+		if err := os.Rename(r.path, backup(1)); err != nil {
+			r.open()
+			return err
+		}
+	} else {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "df"
+
+var (
+	Queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queries_total",
+		Help:      "Queries answered, by listener protocol, query type and response code.",
+	}, []string{"proto", "qtype", "rcode"})
+
+	UpstreamRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_requests_total",
+		Help:      "Requests sent to each upstream, every parallel or retried attempt included.",
+	}, []string{"upstream"})
+
+	UpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Requests to each upstream that failed.",
+	}, []string{"upstream"})
+
+	UpstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_request_duration_seconds",
+		Help:      "Round trip time of successful upstream requests.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"upstream"})
+
+	UpstreamHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "upstream_healthy",
+		Help:      "Whether the health check keeps each upstream of each group in selection (1) or ejected it (0).",
+	}, []string{"group", "upstream"})
+
+	// Answered counts the queries each upstream won, which under the
+	// parallel and fastest policies differs from the requests it was sent.
+	Answered = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_answers_total",
+		Help:      "Queries answered by each upstream.",
+	}, []string{"upstream"})
+
+	Cache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Cache lookups by result, hit or miss.",
+	}, []string{"result"})
+
+	Blocked = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "blocked_queries_total",
+		Help:      "Blocked queries by rule source.",
+	}, []string{"source"})
+
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_queries_total",
+		Help:      "Queries over the rate limit by listener protocol, action (dropped, truncated or refused) and limit (client for the per IP and subnet buckets, user for the DoH user's).",
+	}, []string{"proto", "action", "limit"})
+
+	Denied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "denied_clients_total",
+		Help:      "Queries or connections turned away by the listener access lists, by protocol.",
+	}, []string{"proto"})
+
+	Connections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "open_connections",
+		Help:      "Open client connections by listener protocol.",
+	}, []string{"proto"})
+)
+
+var registry = prometheus.NewRegistry()
+
+func init() {
+	registry.MustRegister(
+		Queries, UpstreamRequests, UpstreamErrors, UpstreamLatency, UpstreamHealthy, Answered,
+		Cache, Blocked, RateLimited, Denied, Connections,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// QType is the qtype label of t. Types unknown to us share one label, so
+// clients can't blow up the number of series.
+func QType(t uint16) string {
+	if s, ok := dns.TypeToString[t]; ok {
+		return s
+	}
+	return "other"
+}
+
+// Rcode is the rcode label of rcode.
+func Rcode(rcode int) string {
+	if s, ok := dns.RcodeToString[rcode]; ok {
+		return s
+	}
+	return "other"
+}
@@ -0,0 +1,103 @@
+package df
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"df/conf"
+	"df/core"
+)
+
+// queryLogCommand implements `df querylog`, searching the query log files of
+// the configured directory, e.g.
+//
+//	df querylog -c config.json -client 192.168.1.20 -domain example.com -since 1h
+func queryLogCommand(args []string) error {
+	fs := flag.NewFlagSet("querylog", flag.ContinueOnError)
+	configPath := fs.String("c", "", "config file, for query_log.dir")
+	dir := fs.String("dir", "", "query log directory, overrides the config")
+	client := fs.String("client", "", "client IP")
+	domain := fs.String("domain", "", "part of the query name")
+	status := fs.String("status", "", "blocked, cached, local, error or a response code like NXDOMAIN")
+	since := fs.Duration("since", 0, "only records from the last duration, e.g. 30m")
+	from := fs.String("from", "", "only records at or after this RFC 3339 time")
+	to := fs.String("to", "", "only records before this RFC 3339 time")
+	limit := fs.Int("limit", 100, "max records")
+	asJSON := fs.Bool("json", false, "print JSON lines")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *dir == "" {
+		if *configPath == "" {
+			return fmt.Errorf("querylog: -c or -dir is required")
+		}
+		conf.LoadConfig(*configPath)
+		*dir = conf.Info().QueryLog.Dir
+		if *dir == "" {
+			return fmt.Errorf("querylog: query_log.dir is not set in %s", *configPath)
+		}
+	}
+
+	f := core.QueryFilter{Client: *client, Domain: *domain, Status: *status, Limit: *limit}
+	if *since > 0 {
+		f.From = time.Now().Add(-*since)
+	}
+	for _, t := range []struct {
+		name, value string
+		dst         *time.Time
+	}{{"from", *from, &f.From}, {"to", *to, &f.To}} {
+		if t.value == "" {
+			continue
+		}
+		tm, err := time.Parse(time.RFC3339, t.value)
+		if err != nil {
+			return fmt.Errorf("querylog: invalid -%s: %w", t.name, err)
+		}
+		*t.dst = tm
+	}
+
+	events, err := core.ReadQueryLog(*dir, f)
+	if err != nil {
+		return fmt.Errorf("querylog: %w", err)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range events {
+			enc.Encode(e)
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tPROTO\tCLIENT\tUSER\tNAME\tTYPE\tRCODE\tSTATUS\tUPSTREAM\tLATENCY")
+	for _, e := range events {
+		status := "-"
+		switch {
+		case e.Blocked:
+			status = "blocked:" + e.BlockedBy
+		case e.Cached:
+			status = "cached"
+		case e.Local:
+			status = "local"
+		case e.Error != "":
+			status = "error: " + e.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.Time.Local().Format(time.DateTime), dash(e.Proto), dash(e.Client), dash(e.User),
+			e.Name, e.Type, e.Rcode, status, dash(e.Upstream), e.Latency.Round(time.Microsecond))
+	}
+	return w.Flush()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -1,23 +1,39 @@
 package df
 
 import (
+	"context"
 	"flag"
-	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"df/conf"
 	"df/core"
-	"df/server"
+	"df/logger"
 )
 
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
 func Run() error {
+	if len(os.Args) > 1 && os.Args[1] == "querylog" {
+		return queryLogCommand(os.Args[2:])
+	}
+
 	// define cmd
 	configPath := flag.String("c", "", "config file")
 	flag.Parse()
 
 	// load config
 	conf.LoadConfig(*configPath)
-	log.Printf("[info] successfully loaded configuration file: %s\n", *configPath)
-	log.Printf("%#v", conf.Info())
+	if err := logger.Setup(conf.Info().Log); err != nil {
+		slog.Error("setup logging", "err", err)
+		os.Exit(1)
+	}
+	slog.Info("configuration loaded", "path", *configPath)
+	slog.Debug("configuration", "config", conf.Info())
 
 	// upstream
 	core.Init()
@@ -27,31 +43,44 @@ func Run() error {
 	return nil
 }
 
+// Server starts every configured listener and reloads the config on SIGHUP or
+// when the config file changes.
 func Server() error {
-	cfg := conf.Info()
+	sup := newSupervisor()
+	sup.apply(conf.Info())
 
-	go func() {
-		if err := server.Standard(cfg.Server.Standard); err != nil {
-			log.Printf("[error] standard: %v", err)
-		}
-	}()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
-	go func() {
-		if err := server.Dot(); err != nil {
-			log.Printf("[error] dot: %v", err)
-		}
-	}()
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
 
-	go func() {
-		if err := server.Doq(); err != nil {
-			log.Printf("[error] doq: %v", err)
+	changed := make(chan struct{}, 1)
+	go conf.Watch(context.Background(), configPollInterval, func() {
+		select {
+		case changed <- struct{}{}:
+		default:
 		}
-	}()
+	})
 
-	go func() {
-		if err := server.Doh(); err != nil {
-			log.Printf("[error] doh: %v", err)
+	for {
+		select {
+		case sig := <-term:
+			slog.Info("shutting down", "signal", sig.String())
+			sup.stopAll()
+			core.Close()
+			slog.Info("shutdown complete")
+			logger.Close()
+			return nil
+		case <-hup:
+			slog.Info("SIGHUP received, reloading config")
+		case <-changed:
+			slog.Info("config file changed, reloading config")
+		}
+		if err := reload(sup); err != nil {
+			slog.Error("reload failed", "err", err)
+			continue
 		}
-	}()
-	select {}
+		slog.Info("config reloaded")
+	}
 }
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"df/conf"
+	"df/metrics"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// acl applies the conf.ACLConfig of one listener.
+type acl struct {
+	allow  []netip.Prefix
+	deny   []netip.Prefix
+	drop   bool
+	denied prometheus.Counter
+}
+
+// newACL returns the access list of the listener called proto, nil if it
+// lets everyone in.
+func newACL(proto string) *acl {
+	cfg := conf.Info().Server.Access(proto)
+	if len(cfg.AllowPrefixes) == 0 && len(cfg.DenyPrefixes) == 0 {
+		return nil
+	}
+	return &acl{
+		allow:  cfg.AllowPrefixes,
+		deny:   cfg.DenyPrefixes,
+		drop:   cfg.Action == conf.ACLDrop,
+		denied: metrics.Denied.WithLabelValues(proto),
+	}
+}
+
+// permits reports whether client may use the listener, counting it if not.
+// A nil acl permits everyone, as does any acl a unix socket peer, which has no
+// address.
+func (a *acl) permits(client netip.Addr) bool {
+	if a == nil || !client.IsValid() {
+		return true
+	}
+	ok := a.check(client)
+	if !ok {
+		a.denied.Inc()
+	}
+	return ok
+}
+
+func (a *acl) check(client netip.Addr) bool {
+	for _, p := range a.deny {
+		if p.Contains(client) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, p := range a.allow {
+		if p.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// refusedHeader answers the query in buf with REFUSED without parsing it:
+// the reply is the query header with QR set and no records. It returns nil
+// for something that isn't a query.
+func refusedHeader(buf []byte) []byte {
+	const qr = 0x80
+	if len(buf) < 12 || buf[2]&qr != 0 {
+		return nil
+	}
+	out := make([]byte, 12)
+	copy(out, buf[:2])
+	// keep the opcode and RD
+	out[2] = qr | buf[2]&0x79
+	out[3] = dns.RcodeRefused
+	return out
+}
+
+// reject turns away a denied stream connection, closing it at once or
+// after answering its first query with REFUSED.
+func (a *acl) reject(conn net.Conn) {
+	if a.drop {
+		conn.Close()
+		return
+	}
+	refuseStream(conn)
+}
+
+// refuseStream answers the first length prefixed query on conn with REFUSED
+// and closes it, a denied client gets nothing more out of the connection.
+func refuseStream(conn interface {
+	io.ReadWriteCloser
+	SetDeadline(time.Time) error
+}) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	lengthBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lengthBuf); err != nil {
+		return
+	}
+	msgBuf := make([]byte, binary.BigEndian.Uint16(lengthBuf))
+	if _, err := io.ReadFull(conn, msgBuf); err != nil {
+		return
+	}
+	resp := refusedHeader(msgBuf)
+	if resp == nil {
+		return
+	}
+	out := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+	_, _ = conn.Write(append(out, resp...))
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+)
+
+// clientAddr extracts the client IP from a connection address.
+func clientAddr(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap()
+	case nil:
+		return netip.Addr{}
+	}
+	return remoteAddr(addr.String())
+}
+
+// remoteAddr parses an "ip:port" string such as http.Request.RemoteAddr.
+func remoteAddr(s string) netip.Addr {
+	ap, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
@@ -0,0 +1,14 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// secureEqual compares a and b in constant time. Hashing first hides the
+// length of the secret as well.
+func secureEqual(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
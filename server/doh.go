@@ -1,12 +1,15 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -18,97 +21,35 @@ import (
 	"golang.org/x/net/http2"
 )
 
-func Doh() error {
-	go func() {
-		if err := Http2(); err != nil {
-			fmt.Printf("UDP server error: %v\n", err)
-		}
-	}()
+// Doh runs the HTTP/2 and HTTP/3 listeners of each address until ctx is
+// done.
+func Doh(ctx context.Context) error {
+	// all share one handler, so a client has the same limits on each
+	cfg := conf.Info()
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Server.Doh.Path, dohHandler(cfg.Server.Doh.Auth, peerIP, newACL("doh"), newRateLimiter("doh")))
 
-	go func() {
-		if err := Http3(); err != nil {
-			fmt.Printf("UDP server error: %v\n", err)
-		}
-	}()
-	select {}
+	var runs []func(context.Context) error
+	for _, addr := range cfg.Server.Doh.Listen {
+		runs = append(runs, func(ctx context.Context) error {
+			return Http2(ctx, addr, mux)
+		}, func(ctx context.Context) error {
+			return Http3(ctx, addr, mux)
+		})
+	}
+	return runAll(ctx, runs...)
 }
 
 // Http2()
 //
 // https://datatracker.ietf.org/doc/html/rfc8484
-func Http2() error {
+func Http2(ctx context.Context, addr string, handler http.Handler) error {
 	cfg := conf.Info()
-	path := cfg.Server.Doh.Path
-	auths := cfg.Server.Doh.Auth
-
-	mux := http.NewServeMux()
-	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
-		// Basic Auth
-		auth := r.Header.Get("Authorization")
-		isAuthed := dohBasicAuth(auth, auths)
-		_ = isAuthed
-
-		// Parse DNS Request
-		var queryMsg []byte
-		var err error
-		switch r.Method {
-		case http.MethodGet:
-			dnsParam := r.URL.Query().Get("dns")
-			if dnsParam == "" {
-				http.Error(w, "missing dns param", http.StatusBadRequest)
-				return
-			}
-			queryMsg, err = base64.RawURLEncoding.DecodeString(dnsParam)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("invalid dns param: %v", err), http.StatusBadRequest)
-				return
-			}
-		case http.MethodPost:
-			if r.Header.Get("Content-Type") != "application/dns-message" {
-				http.Error(w, "invalid content-type", http.StatusUnsupportedMediaType)
-				return
-			}
-			queryMsg, err = io.ReadAll(r.Body)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusInternalServerError)
-				return
-			}
-		default:
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		req := new(dns.Msg)
-		if err := req.Unpack(queryMsg); err != nil {
-			http.Error(w, fmt.Sprintf("failed to parse DNS message: %v", err), http.StatusBadRequest)
-			return
-		}
-
-		// DNS Exchange
-		resp, err := core.Core(req)
-		if err != nil {
-			servfail := new(dns.Msg)
-			servfail.SetRcode(req, dns.RcodeServerFailure)
-			resp = servfail
-		}
-
-		respMsg, err := resp.Pack()
-		if err != nil {
-			log.Printf("[error] pack response: %v", err)
-			return
-		}
-
-		w.Header().Set("Content-Type", "application/dns-message")
-		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.WriteHeader(http.StatusOK)
-		w.Write(respMsg)
-	})
 
 	// HTTP/2
-	addr := fmt.Sprintf(":%d", cfg.Server.Doh.Port)
 	srv := &http.Server{
 		Addr:           addr,
-		Handler:        mux,
+		Handler:        handler,
 		IdleTimeout:    time.Duration(30) * time.Second,
 		MaxHeaderBytes: 512,
 		TLSConfig: &tls.Config{
@@ -124,25 +65,84 @@ func Http2() error {
 		return fmt.Errorf("failed to configure http2: %w", err)
 	}
 
-	log.Printf("[info] DoH server (HTTP/2) started on: %s", addr)
-	err := srv.ListenAndServeTLS(cfg.TLS.PublicKey, cfg.TLS.PrivateKey)
+	slog.Info("DoH server (HTTP/2) started", "addr", addr)
+	err := runHTTP(ctx, func() error {
+		return srv.ListenAndServeTLS(cfg.TLS.PublicKey, cfg.TLS.PrivateKey)
+	}, srv.Shutdown)
 	if err != nil {
-		return fmt.Errorf("[fatal] can't start http/2 server")
+		return fmt.Errorf("[fatal] can't start http/2 server: %w", err)
 	}
 	return nil
 }
 
-func Http3() error {
+func Http3(ctx context.Context, addr string, handler http.Handler) error {
 	cfg := conf.Info()
-	path := cfg.Server.Doh.Path
-	auths := cfg.Server.Doh.Auth
 
-	mux := http.NewServeMux()
-	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+	// cert
+	cert, err := tls.LoadX509KeyPair(cfg.TLS.PublicKey, cfg.TLS.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to load cert/key: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h3"}, // HTTP/3
+	}
+
+	server := &http3.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsCfg,
+	}
+	slog.Info("DoH server (HTTP/3) started", "addr", addr)
+	if err := runHTTP(ctx, server.ListenAndServe, server.Shutdown); err != nil {
+		return fmt.Errorf("[fatal] can't start http/3 server: %w", err)
+	}
+	return nil
+}
+
+// dohHandler serves RFC 8484 queries, it's shared by HTTP/2, HTTP/3 and the
+// plain HTTP listener. clientIP tells where a request came from.
+func dohHandler(auths []conf.AuthDohItem, clientIP func(r *http.Request) netip.Addr, access *acl, limit *rateLimiter) http.HandlerFunc {
+	limits := make(map[string]*tokenBucket)
+	for _, a := range auths {
+		if a.RateLimit > 0 {
+			limits[a.User] = newTokenBucket(a.RateLimit, a.RateLimit)
+		}
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := clientIP(r)
+		if !access.permits(client) {
+			if access.drop {
+				// net/http and http3 reset the stream without logging
+				panic(http.ErrAbortHandler)
+			}
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if !limit.allowed(client) {
+			limit.refused()
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+
 		// Basic Auth
-		auth := r.Header.Get("Authorization")
-		isAuthed := dohBasicAuth(auth, auths)
-		_ = isAuthed
+		var user string
+		if len(auths) > 0 {
+			item, ok := dohBasicAuth(r.Header.Get("Authorization"), auths)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Basic realm="dns"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			user = item.User
+
+			if l, ok := limits[user]; ok && !l.allow() {
+				userRefused()
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+				return
+			}
+		}
 
 		// Parse DNS Request
 		var queryMsg []byte
@@ -164,7 +164,11 @@ func Http3() error {
 				http.Error(w, "invalid content-type", http.StatusUnsupportedMediaType)
 				return
 			}
-			queryMsg, err = io.ReadAll(r.Body)
+			queryMsg, err = io.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+			if tooLarge := (*http.MaxBytesError)(nil); errors.As(err, &tooLarge) {
+				http.Error(w, "dns message too large", http.StatusRequestEntityTooLarge)
+				return
+			}
 			if err != nil {
 				http.Error(w, fmt.Sprintf("failed to read body: %v", err), http.StatusInternalServerError)
 				return
@@ -180,7 +184,7 @@ func Http3() error {
 		}
 
 		// DNS Exchange
-		resp, err := core.Core(req)
+		resp, err := core.Core(req, core.Client{Addr: client, User: user, Proto: dohProto(r)})
 		if err != nil {
 			servfail := new(dns.Msg)
 			servfail.SetRcode(req, dns.RcodeServerFailure)
@@ -189,7 +193,7 @@ func Http3() error {
 
 		respMsg, err := resp.Pack()
 		if err != nil {
-			log.Printf("[error] pack response: %v", err)
+			slog.Error("pack response", "err", err)
 			return
 		}
 
@@ -198,57 +202,58 @@ func Http3() error {
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.WriteHeader(http.StatusOK)
 		w.Write(respMsg)
-	})
-
-	// cert
-	cert, err := tls.LoadX509KeyPair(cfg.TLS.PublicKey, cfg.TLS.PrivateKey)
-	if err != nil {
-		return fmt.Errorf("failed to load cert/key: %w", err)
-	}
-	tlsCfg := &tls.Config{
-		Certificates: []tls.Certificate{cert},
-		NextProtos:   []string{"h3"}, // HTTP/3
 	}
+}
 
-	addr := fmt.Sprintf(":%d", cfg.Server.Doh.Port)
-	server := &http3.Server{
-		Addr:      addr,
-		Handler:   mux,
-		TLSConfig: tlsCfg,
-	}
-	log.Printf("[info] DoH server (HTTP/3) started on: %s", addr)
-	if err := server.ListenAndServe(); err != nil {
-		return fmt.Errorf("[fatal] can't start http/3 server: %w", err)
+// dohProto names the protocol r arrived over for the query log.
+func dohProto(r *http.Request) string {
+	switch {
+	case r.ProtoMajor == 3:
+		return "doh3"
+	case r.TLS == nil:
+		return "http"
+	default:
+		return "doh2"
 	}
-	return nil
+}
+
+func peerIP(r *http.Request) netip.Addr {
+	return remoteAddr(r.RemoteAddr)
 }
 
 // Basic Auth
-func dohBasicAuth(auth string, auths []conf.AuthDohItem) bool {
+//
+// Every item is compared in constant time, so the response time doesn't
+// reveal which user names exist.
+func dohBasicAuth(auth string, auths []conf.AuthDohItem) (*conf.AuthDohItem, bool) {
 	if auth == "" {
-		return false
+		return nil, false
 	}
 
 	parts := strings.SplitN(auth, " ", 2)
 	if len(parts) != 2 || parts[0] != "Basic" {
-		return false
+		return nil, false
 	}
 
 	payload, err := base64.StdEncoding.DecodeString(parts[1])
 	if err != nil {
-		return false
+		return nil, false
 	}
 
 	userPass := strings.SplitN(string(payload), ":", 2)
 	if len(userPass) != 2 {
-		return false
+		return nil, false
 	}
 
-	for _, v := range auths {
-		if v.User == userPass[0] && v.Password == userPass[1] {
-			return true
+	var found *conf.AuthDohItem
+	for i, v := range auths {
+		// no short-circuit, every item costs the same
+		ok := secureEqual(userPass[0], v.User)
+		ok = secureEqual(userPass[1], v.Password) && ok
+		if ok && found == nil {
+			found = &auths[i]
 		}
 	}
 
-	return false
+	return found, found != nil
 }
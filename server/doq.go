@@ -4,25 +4,31 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/netip"
+	"sync"
 	"time"
 
 	"df/conf"
 	"df/core"
+	"df/metrics"
 
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 )
 
+var errDenied = errors.New("client denied")
+
 // RFC 9250
-func Doq() error {
+func Doq(ctx context.Context) error {
 	cfg := conf.Info()
 	cert, err := tls.LoadX509KeyPair(cfg.TLS.PublicKey, cfg.TLS.PrivateKey)
 	if err != nil {
-		log.Fatalf("[fatal] load cert/key: %v", err)
+		return fmt.Errorf("load cert/key: %w", err)
 	}
 
 	tlsCfg := &tls.Config{
@@ -31,13 +37,6 @@ func Doq() error {
 		MinVersion:   tls.VersionTLS13,
 	}
 
-	addr := fmt.Sprintf("0.0.0.0:%d", cfg.Server.Doq)
-
-	uc, err := net.ListenPacket("udp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to listen socket: %w", err)
-	}
-
 	idleTimeout := time.Duration(30) * time.Second
 	quicConfig := &quic.Config{
 		MaxIdleTimeout:                 idleTimeout,
@@ -51,90 +50,158 @@ func Doq() error {
 		MaxIncomingUniStreams: -1,
 	}
 
-	srk, _, err := InitQUICSrkFromIfaceMac()
-	if err != nil {
-		log.Printf("[warn] can't create StatelessResetKey, it will be disable: %v", err)
-	}
-
-	quicTransport := &quic.Transport{
-		Conn:              uc,
-		StatelessResetKey: (*quic.StatelessResetKey)(srk),
+	// denied clients are refused on their first packet, before any TLS work
+	access := newACL("doq")
+	if access != nil {
+		quicConfig.GetConfigForClient = func(info *quic.ClientInfo) (*quic.Config, error) {
+			if !access.permits(clientAddr(info.RemoteAddr)) {
+				return nil, errDenied
+			}
+			return quicConfig, nil
+		}
 	}
 
-	listener, err := quicTransport.Listen(tlsCfg, quicConfig)
+	srk, _, err := InitQUICSrkFromIfaceMac()
 	if err != nil {
-		log.Fatal("[fatal] can't start quic server")
+		slog.Warn("can't create StatelessResetKey, stateless reset disabled", "err", err)
 	}
-	defer listener.Close()
 
-	log.Printf("[info] DoQ server started on %s", addr)
-
-	for {
-		conn, err := listener.Accept(context.Background())
+	var listeners []*quic.Listener
+	for _, addr := range cfg.Server.Doq {
+		uc, err := net.ListenPacket("udp", addr)
 		if err != nil {
-			log.Printf("[error] accept connection: %v", err)
-			continue
+			return fmt.Errorf("failed to listen socket %s: %w", addr, err)
 		}
+		quicTransport := &quic.Transport{
+			Conn:              uc,
+			StatelessResetKey: (*quic.StatelessResetKey)(srk),
+		}
+		defer uc.Close()
+		defer quicTransport.Close()
 
-		go handleQuicConn(conn)
-	}
-
+		listener, err := quicTransport.Listen(tlsCfg, quicConfig)
+		if err != nil {
+			return fmt.Errorf("can't start quic server: %w", err)
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
+	}
+
+	slog.Info("DoQ server started", "addr", cfg.Server.Doq)
+
+	var conns, accepting sync.WaitGroup
+	limit := newRateLimiter("doq")
+	open := metrics.Connections.WithLabelValues("doq")
+	for _, listener := range listeners {
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			for {
+				conn, err := listener.Accept(ctx)
+				if err != nil {
+					if ctx.Err() != nil || errors.Is(err, quic.ErrServerClosed) {
+						return
+					}
+					slog.Error("doq: accept connection", "err", err)
+					continue
+				}
+
+				conns.Add(1)
+				open.Inc()
+				go func() {
+					defer conns.Done()
+					defer open.Dec()
+					handleQuicConn(ctx, conn, limit)
+				}()
+			}
+		}()
+	}
+	accepting.Wait()
+
+	// refuse new handshakes, give the accepted connections time to answer
+	// what they have; closing the transports ends whatever is left
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	if !waitTimeout(&conns, drainTimeout()) {
+		slog.Warn("doq: drain timed out", "addr", cfg.Server.Doq)
+	}
+	return nil
 }
 
-func handleQuicConn(conn *quic.Conn) {
+// handleQuicConn accepts streams until ctx is done, then waits for the
+// streams already accepted before closing conn.
+func handleQuicConn(ctx context.Context, conn *quic.Conn, limit *rateLimiter) {
+	var streams sync.WaitGroup
 	defer conn.CloseWithError(0, "")
+	defer streams.Wait()
+
+	client := clientAddr(conn.RemoteAddr())
 
 	for {
-		stream, err := conn.AcceptStream(context.Background())
+		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
-			log.Printf("[error] accept stream: %v", err)
+			if ctx.Err() == nil {
+				slog.Debug("doq: accept stream", "err", err)
+			}
 			return
 		}
 
-		go handleQuicStream(stream)
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			handleQuicStream(stream, client, limit)
+		}()
 	}
 }
 
-func handleQuicStream(stream *quic.Stream) {
+func handleQuicStream(stream *quic.Stream, client netip.Addr, limit *rateLimiter) {
 	defer stream.Close()
 
 	stream.SetReadDeadline(time.Now().Add(time.Second * 2))
 	lengthBuf := make([]byte, 2)
 
 	if _, err := io.ReadFull(stream, lengthBuf[:]); err != nil {
-		log.Printf("[error] read message length: %v", err)
+		slog.Debug("doq: read message length", "err", err)
 		return
 	}
 	msgLen := binary.BigEndian.Uint16(lengthBuf[:])
 
 	if msgLen == 0 || msgLen > dns.MaxMsgSize {
-		log.Printf("[error] invalid DNS message length: %d", msgLen)
+		slog.Debug("doq: invalid message length", "len", msgLen)
 		return
 	}
 
 	msgBuf := make([]byte, msgLen)
 	if _, err := io.ReadFull(stream, msgBuf); err != nil {
-		log.Printf("[error] read DNS message: %v", err)
+		slog.Debug("doq: read message", "err", err)
 		return
 	}
 
 	req := new(dns.Msg)
 	if err := req.Unpack(msgBuf); err != nil {
-		log.Printf("[error] unpack DNS: %v", err)
+		slog.Debug("doq: bad dns packet", "err", err)
 		return
 	}
 
-	resp, err := core.Core(req)
-	if err != nil {
-		// 返回 SERVFAIL
-		servfail := new(dns.Msg)
-		servfail.SetRcode(req, dns.RcodeServerFailure)
-		resp = servfail
+	var resp *dns.Msg
+	if limit.allowed(client) {
+		var err error
+		resp, err = core.Core(req, core.Client{Addr: client, Proto: "doq"})
+		if err != nil {
+			// 返回 SERVFAIL
+			servfail := new(dns.Msg)
+			servfail.SetRcode(req, dns.RcodeServerFailure)
+			resp = servfail
+		}
+	} else {
+		limit.refused()
+		resp = refusedReply(req)
 	}
 
 	respMsg, err := resp.Pack()
 	if err != nil {
-		log.Printf("[error] pack response: %v", err)
+		slog.Error("doq: pack response", "err", err)
 		return
 	}
 
@@ -145,7 +212,7 @@ func handleQuicStream(stream *quic.Stream) {
 	// 写回 QUIC stream
 	_, err = stream.Write(out)
 	if err != nil {
-		log.Printf("[error] write stream: %v", err)
+		slog.Debug("doq: write stream", "err", err)
 		return
 	}
 }
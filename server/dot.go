@@ -1,12 +1,13 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"time"
 
@@ -17,11 +18,11 @@ import (
 	"github.com/miekg/dns"
 )
 
-func Dot() error {
+func Dot(ctx context.Context) error {
 	cfg := conf.Info()
 	cert, err := tls.LoadX509KeyPair(cfg.TLS.PublicKey, cfg.TLS.PrivateKey)
 	if err != nil {
-		log.Fatalf("[fatal] load cert/key: %v", err)
+		return fmt.Errorf("load cert/key: %w", err)
 	}
 
 	tlsCfg := &tls.Config{
@@ -29,39 +30,47 @@ func Dot() error {
 		MinVersion:   tls.VersionTLS12,
 	}
 
-	addr := fmt.Sprintf("0.0.0.0:%d", cfg.Server.Dot)
-	listener, err := tls.Listen("tcp", addr, tlsCfg)
+	ls, err := listenStreams(cfg.Server.Dot, func(addr string) (net.Listener, error) {
+		return tls.Listen("tcp", addr, tlsCfg)
+	})
 	if err != nil {
-		log.Fatalf("[fatal] can't create dot server: %v", err)
+		return fmt.Errorf("can't create dot server: %w", err)
 	}
-	defer listener.Close()
-	log.Printf("[info] DOT server started on: %s", addr)
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("accept: %v", err)
-			continue
-		}
 
-		go handleDOTConn(conn)
-	}
+	access := newACL("dot")
+	limit := newRateLimiter("dot")
+	slog.Info("DoT server started", "addr", cfg.Server.Dot)
+	acceptAll(ctx, "dot", ls, func(conn net.Conn) {
+		// checked before the handshake, which a dropped client never gets
+		if !access.permits(clientAddr(conn.RemoteAddr())) {
+			access.reject(conn)
+			return
+		}
+		handleDOTConn(ctx, conn, limit)
+	})
+	return nil
 }
 
-func handleDOTConn(conn net.Conn) {
+func handleDOTConn(ctx context.Context, conn net.Conn, limit *rateLimiter) {
 	defer conn.Close()
+	client := clientAddr(conn.RemoteAddr())
 	for {
 		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		// checked after the deadline is set, so a drain can't be missed
+		if ctx.Err() != nil {
+			return
+		}
 		lengthBuf := make([]byte, 2)
 		_, err := io.ReadFull(conn, lengthBuf)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				log.Printf("[info] tcp client closed connection")
+				slog.Debug("dot: client closed connection")
 				return
 			}
 
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
-				log.Printf("[warn] tcp read timeout: %v", err)
+				slog.Debug("dot: read timeout", "err", err)
 				return
 			}
 			return
@@ -69,33 +78,39 @@ func handleDOTConn(conn net.Conn) {
 
 		msgLen := int(binary.BigEndian.Uint16(lengthBuf))
 		if msgLen == 0 || msgLen > 64*1024 {
-			log.Printf("[error] invalid dns length=%d", msgLen)
+			slog.Debug("dot: invalid message length", "len", msgLen)
 			return
 		}
 
 		msgBuf := make([]byte, msgLen)
 		_, err = io.ReadFull(conn, msgBuf)
 		if err != nil {
-			log.Printf("[error] tcp read dns msg: %v", err)
+			slog.Debug("dot: read message", "err", err)
 			return
 		}
 
 		req := new(dns.Msg)
 		if err := req.Unpack(msgBuf); err != nil {
-			log.Printf("[error] bad dns packet: %v", err)
+			slog.Debug("dot: bad dns packet", "err", err)
 			return
 		}
 
-		resp, err := core.Core(req)
-		if err != nil {
-			servfail := new(dns.Msg)
-			servfail.SetRcode(req, dns.RcodeServerFailure)
-			resp = servfail
+		var resp *dns.Msg
+		if limit.allowed(client) {
+			resp, err = core.Core(req, core.Client{Addr: client, Proto: "dot"})
+			if err != nil {
+				servfail := new(dns.Msg)
+				servfail.SetRcode(req, dns.RcodeServerFailure)
+				resp = servfail
+			}
+		} else {
+			limit.refused()
+			resp = refusedReply(req)
 		}
 
 		respMsg, err := resp.Pack()
 		if err != nil {
-			log.Printf("[error] pack response: %v", err)
+			slog.Error("dot: pack response", "err", err)
 			return
 		}
 
@@ -105,11 +120,8 @@ func handleDOTConn(conn net.Conn) {
 
 		_, err = conn.Write(out)
 		if err != nil {
-			log.Printf("[error] write tcp response: %v", err)
+			slog.Debug("dot: write response", "err", err)
 			return
 		}
-
-		// 刷新 deadline，防止长连接挂住
-		_ = conn.SetReadDeadline(time.Now().Add(15 * time.Second))
 	}
 }
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"df/conf"
+	"df/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// drainTimeout is how long a stopped listener waits for queries in flight.
+func drainTimeout() time.Duration {
+	return time.Duration(conf.Info().Server.DrainTimeout) * time.Second
+}
+
+// waitTimeout waits for wg up to d and reports whether it finished.
+func waitTimeout(wg *sync.WaitGroup, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+// connTracker keeps the open connections of a stream listener so they can be
+// drained when it stops.
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+	open  prometheus.Gauge
+}
+
+func newConnTracker(proto string) *connTracker {
+	return &connTracker{
+		conns: make(map[net.Conn]struct{}),
+		open:  metrics.Connections.WithLabelValues(proto),
+	}
+}
+
+func (t *connTracker) add(c net.Conn) {
+	t.mu.Lock()
+	t.conns[c] = struct{}{}
+	t.mu.Unlock()
+	t.wg.Add(1)
+	t.open.Inc()
+}
+
+func (t *connTracker) done(c net.Conn) {
+	t.mu.Lock()
+	delete(t.conns, c)
+	t.mu.Unlock()
+	t.open.Dec()
+	t.wg.Done()
+}
+
+// drain must be called after the accept loop has returned. Idle connections
+// are woken up right away, a query being answered gets until the drain
+// timeout, then everything left is closed.
+func (t *connTracker) drain() {
+	t.mu.Lock()
+	for c := range t.conns {
+		_ = c.SetReadDeadline(time.Now())
+	}
+	t.mu.Unlock()
+
+	if waitTimeout(&t.wg, drainTimeout()) {
+		return
+	}
+
+	t.mu.Lock()
+	for c := range t.conns {
+		c.Close()
+	}
+	t.mu.Unlock()
+	t.wg.Wait()
+}
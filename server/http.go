@@ -1,5 +1,118 @@
 package server
 
-func Http() error {
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"df/conf"
+)
+
+// Http serves RFC 8484 over cleartext HTTP/1.1 and h2c. It's meant to sit
+// behind a TLS terminating reverse proxy.
+func Http(ctx context.Context) error {
+	cfg := conf.Info()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Server.HTTP.Path, dohHandler(nil, func(r *http.Request) netip.Addr {
+		return forwardedIP(r, cfg.Server.HTTP.TrustedPrefixes)
+	}, newACL("http"), newRateLimiter("http")))
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	var runs []func(context.Context) error
+	for _, addr := range cfg.Server.HTTP.Listen {
+		srv := &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			Protocols:         &protocols,
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       10 * time.Second,
+			IdleTimeout:       30 * time.Second,
+			MaxHeaderBytes:    4096,
+		}
+		runs = append(runs, func(ctx context.Context) error {
+			slog.Info("DNS over HTTP server started", "addr", addr)
+			if err := runHTTP(ctx, srv.ListenAndServe, srv.Shutdown); err != nil {
+				return fmt.Errorf("[fatal] can't start http server: %w", err)
+			}
+			return nil
+		})
+	}
+	return runAll(ctx, runs...)
+}
+
+// runHTTP runs serve until ctx is done, then shuts the server down gracefully.
+func runHTTP(ctx context.Context, serve func() error, shutdown func(context.Context) error) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- serve()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	sctx, cancel := context.WithTimeout(context.Background(), drainTimeout())
+	defer cancel()
+	if err := shutdown(sctx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
 	return nil
 }
+
+// forwardedIP recovers the client IP of a proxied request. The headers are
+// only honored if the peer is a trusted proxy; X-Forwarded-For is walked from
+// the right, skipping trusted hops, so a client can't spoof its address by
+// prepending entries.
+func forwardedIP(r *http.Request, trusted []netip.Prefix) netip.Addr {
+	peer := remoteAddr(r.RemoteAddr)
+	if !isTrusted(peer, trusted) {
+		return peer
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			addr = addr.Unmap()
+			if !isTrusted(addr, trusted) || i == 0 {
+				return addr
+			}
+		}
+	}
+
+	if v := r.Header.Get("X-Real-IP"); v != "" {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(v)); err == nil {
+			return addr.Unmap()
+		}
+	}
+	return peer
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestForwardedIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string
+	}{{
+		name:   "direct client",
+		remote: "192.0.2.1:5353",
+		want:   "192.0.2.1",
+	}, {
+		name:   "untrusted peer can't spoof",
+		remote: "192.0.2.1:5353",
+		xff:    []string{"198.51.100.7"},
+		realIP: "198.51.100.8",
+		want:   "192.0.2.1",
+	}, {
+		name:   "trusted proxy",
+		remote: "10.0.0.1:5353",
+		xff:    []string{"198.51.100.7"},
+		want:   "198.51.100.7",
+	}, {
+		name:   "prepended entries are ignored",
+		remote: "10.0.0.1:5353",
+		xff:    []string{"203.0.113.9, 198.51.100.7"},
+		want:   "198.51.100.7",
+	}, {
+		name:   "trusted hops are skipped",
+		remote: "10.0.0.1:5353",
+		xff:    []string{"203.0.113.9, 198.51.100.7, 10.0.0.2"},
+		want:   "198.51.100.7",
+	}, {
+		name:   "repeated headers",
+		remote: "10.0.0.1:5353",
+		xff:    []string{"198.51.100.7", "10.0.0.2"},
+		want:   "198.51.100.7",
+	}, {
+		name:   "only trusted hops",
+		remote: "10.0.0.1:5353",
+		xff:    []string{"10.0.0.3, 10.0.0.2"},
+		want:   "10.0.0.3",
+	}, {
+		name:   "mapped address",
+		remote: "10.0.0.1:5353",
+		xff:    []string{"::ffff:198.51.100.7"},
+		want:   "198.51.100.7",
+	}, {
+		name:   "ipv6",
+		remote: "[fd00::1]:5353",
+		xff:    []string{"2001:db8::7"},
+		want:   "2001:db8::7",
+	}, {
+		name:   "garbage falls back to the real ip header",
+		remote: "10.0.0.1:5353",
+		xff:    []string{"unknown"},
+		realIP: "198.51.100.8",
+		want:   "198.51.100.8",
+	}, {
+		name:   "real ip header",
+		remote: "10.0.0.1:5353",
+		realIP: " 198.51.100.8 ",
+		want:   "198.51.100.8",
+	}, {
+		name:   "no headers",
+		remote: "10.0.0.1:5353",
+		want:   "10.0.0.1",
+	}, {
+		name:   "garbage everywhere",
+		remote: "10.0.0.1:5353",
+		xff:    []string{"unknown"},
+		realIP: "unknown",
+		want:   "10.0.0.1",
+	}, {
+		name:   "unparsable peer",
+		remote: "@",
+		xff:    []string{"198.51.100.7"},
+		want:   "invalid IP",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/dns-query", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := forwardedIP(r, trusted).String(); got != tt.want {
+				t.Errorf("forwardedIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
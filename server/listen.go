@@ -0,0 +1,111 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"df/conf"
+)
+
+// runAll runs each of runs until ctx is done, one failing takes the others
+// down too.
+func runAll(ctx context.Context, runs ...func(context.Context) error) error {
+	if len(runs) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errCh := make(chan error, len(runs))
+	for _, run := range runs {
+		go func() {
+			errCh <- run(ctx)
+		}()
+	}
+
+	errs := []error{<-errCh}
+	cancel()
+	for range len(runs) - 1 {
+		errs = append(errs, <-errCh)
+	}
+	return errors.Join(errs...)
+}
+
+// isUnix reports whether addr names a unix socket.
+func isUnix(addr string) bool {
+	return strings.HasPrefix(addr, conf.UnixPrefix)
+}
+
+// listenStream binds a TCP address or a unix socket, replacing the socket
+// file a previous run left behind.
+func listenStream(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, conf.UnixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+// listenStreams binds every one of addrs, or none if one fails.
+func listenStreams(addrs []string, bind func(addr string) (net.Listener, error)) ([]net.Listener, error) {
+	var ls []net.Listener
+	for _, addr := range addrs {
+		l, err := bind(addr)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to bind address %s: %w", addr, err)
+		}
+		ls = append(ls, l)
+	}
+	return ls, nil
+}
+
+// acceptAll hands the connections of ls to handle until ctx is done, then
+// waits for them to drain.
+func acceptAll(ctx context.Context, proto string, ls []net.Listener, handle func(conn net.Conn)) {
+	stop := context.AfterFunc(ctx, func() {
+		for _, l := range ls {
+			l.Close()
+		}
+	})
+	defer stop()
+
+	conns := newConnTracker(proto)
+	defer conns.drain()
+
+	var wg sync.WaitGroup
+	for _, l := range ls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer l.Close()
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
+					slog.Error(proto+": accept", "err", err)
+					continue
+				}
+				conns.add(conn)
+				go func() {
+					defer conns.done(conn)
+					handle(conn)
+				}()
+			}
+		}()
+	}
+	wg.Wait()
+}
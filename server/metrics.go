@@ -0,0 +1,32 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"df/metrics"
+)
+
+// Metrics serves the Prometheus metrics on port for scrapers that can't use
+// the panel credentials.
+func Metrics(ctx context.Context, port int) error {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	addr := fmt.Sprintf(":%d", port)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	slog.Info("metrics server started", "addr", addr)
+	if err := runHTTP(ctx, srv.ListenAndServe, srv.Shutdown); err != nil {
+		return fmt.Errorf("[fatal] can't start metrics server: %w", err)
+	}
+	return nil
+}
@@ -1,5 +1,169 @@
 package server
 
-func Panel(port int) error {
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"df/conf"
+	"df/core"
+	"df/metrics"
+)
+
+//go:embed panel
+var panelFiles embed.FS
+
+// Panel serves the admin web panel and its JSON API behind the panel
+// credentials.
+func Panel(ctx context.Context, port int) error {
+	auth := conf.Info().Panel.Auth
+
+	static, err := fs.Sub(panelFiles, "panel")
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(static))
+	mux.HandleFunc("GET /api/queries", panelQueries)
+	mux.HandleFunc("GET /api/log", panelLog)
+	mux.HandleFunc("GET /api/stats", panelStats)
+	mux.HandleFunc("GET /api/rules", panelRules)
+	mux.HandleFunc("PUT /api/rules", panelSetRule)
+	mux.HandleFunc("POST /api/cache/flush", panelFlushCache)
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	addr := fmt.Sprintf(":%d", port)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           panelAuth(auth, mux),
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+
+	slog.Info("panel started", "addr", addr)
+	if err := runHTTP(ctx, srv.ListenAndServe, srv.Shutdown); err != nil {
+		return fmt.Errorf("[fatal] can't start panel: %w", err)
+	}
 	return nil
 }
+
+func panelAuth(auth conf.AuthPanelConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		ok := secureEqual(user, auth.User)
+		ok = secureEqual(pass, auth.Password) && ok
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="panel"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func panelQueries(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+	writeJSON(w, core.RecentQueries(limit))
+}
+
+// panelLog searches the query log. from and to are RFC 3339 times.
+func panelLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := core.QueryFilter{
+		Client: q.Get("client"),
+		Domain: q.Get("domain"),
+		Status: q.Get("status"),
+	}
+	f.Limit, _ = strconv.Atoi(q.Get("limit"))
+	for _, t := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		v := q.Get(t.name)
+		if v == "" {
+			continue
+		}
+		tm, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s: %v", t.name, err), http.StatusBadRequest)
+			return
+		}
+		*t.dst = tm
+	}
+
+	events, err := core.SearchQueries(f)
+	if err != nil {
+		slog.Error("panel: search query log", "err", err)
+		http.Error(w, "search failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, events)
+}
+
+func panelStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{
+		"upstreams":   core.UpstreamStats(),
+		"top_blocked": core.TopBlocked(20),
+		"top_clients": core.TopClients(20),
+	})
+}
+
+func panelRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, core.RuleSources())
+}
+
+func panelSetRule(w http.ResponseWriter, r *http.Request) {
+	if !jsonRequest(w, r) {
+		return
+	}
+	var body struct {
+		Name    string `json:"name"`
+		Enabled bool   `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	core.SetRuleSource(body.Name, body.Enabled)
+	slog.Info("panel: rule source switched", "source", body.Name, "enabled", body.Enabled)
+	writeJSON(w, core.RuleSources())
+}
+
+func panelFlushCache(w http.ResponseWriter, r *http.Request) {
+	if !jsonRequest(w, r) {
+		return
+	}
+	core.FlushCache()
+	slog.Info("panel: cache flushed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// jsonRequest rejects a state changing request that isn't JSON. A browser
+// replays the panel's Basic credentials for any site, but only a CORS
+// preflight, which we never grant, lets another site send this content type.
+func jsonRequest(w http.ResponseWriter, r *http.Request) bool {
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "application/json" {
+		http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("panel: encode response", "err", err)
+	}
+}
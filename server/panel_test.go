@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJSONRequest(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"", false},
+		// the types a cross-site form or fetch can send without preflight
+		{"text/plain", false},
+		{"application/x-www-form-urlencoded", false},
+		{"multipart/form-data; boundary=x", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/api/cache/flush", nil)
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		if got := jsonRequest(w, r); got != tt.want {
+			t.Errorf("jsonRequest(%q) = %t, want %t", tt.contentType, got, tt.want)
+		}
+		if !tt.want && w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("jsonRequest(%q) status = %d", tt.contentType, w.Code)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"df/conf"
+	"df/metrics"
+
+	"github.com/miekg/dns"
+)
+
+// tokenBucket is a simple token bucket refilled at rate tokens per second.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes one token if available.
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket refilled completely, so it can be dropped
+// and made again on demand.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+const (
+	// limiterMaxBuckets caps each bucket map, so a flood of spoofed sources
+	// can't grow them without bound.
+	limiterMaxBuckets = 1 << 16
+	// limiterSweepBatch is the number of buckets of each map every query
+	// checks for idleness. Map iteration starts at random, so the idle ones
+	// go away over time without a pause to walk the whole map.
+	limiterSweepBatch = 8
+)
+
+// rateLimiter applies the conf.RateLimitConfig of one listener.
+type rateLimiter struct {
+	proto string
+	cfg   conf.RateLimitConfig
+	allow []netip.Prefix
+
+	mu      sync.Mutex
+	ips     map[netip.Addr]*tokenBucket
+	subnets map[netip.Prefix]*tokenBucket
+	// overflow buckets are shared by the clients that find their map full
+	ipOverflow, subnetOverflow *tokenBucket
+
+	limited atomic.Uint64
+}
+
+// newRateLimiter returns the limiter of the listener called proto, nil if
+// it's unlimited.
+func newRateLimiter(proto string) *rateLimiter {
+	return newLimiter(proto, conf.Info().Server.Limits(proto))
+}
+
+func newLimiter(proto string, cfg conf.RateLimitConfig) *rateLimiter {
+	if cfg.PerIP == 0 && cfg.PerSubnet == 0 {
+		return nil
+	}
+	l := &rateLimiter{
+		proto:   proto,
+		cfg:     cfg,
+		ips:     make(map[netip.Addr]*tokenBucket),
+		subnets: make(map[netip.Prefix]*tokenBucket),
+		allow:   cfg.AllowPrefixes,
+	}
+	if cfg.PerIP > 0 {
+		l.ipOverflow = newTokenBucket(cfg.PerIP, cfg.Burst)
+	}
+	if cfg.PerSubnet > 0 {
+		l.subnetOverflow = newTokenBucket(cfg.PerSubnet, cfg.Burst)
+	}
+	return l
+}
+
+// allowed takes a token for client from its IP and its subnet bucket. A nil
+// limiter allows everything.
+func (l *rateLimiter) allowed(client netip.Addr) bool {
+	if l == nil || !client.IsValid() {
+		return true
+	}
+	for _, p := range l.allow {
+		if p.Contains(client) {
+			return true
+		}
+	}
+
+	bits := l.cfg.IPv6Prefix
+	if client.Is4() {
+		bits = l.cfg.IPv4Prefix
+	}
+	subnet, _ := client.Prefix(bits)
+
+	l.mu.Lock()
+	l.sweep(time.Now())
+	var ip, sn *tokenBucket
+	if l.cfg.PerIP > 0 {
+		ip = l.ips[client]
+		switch {
+		case ip != nil:
+		case len(l.ips) < limiterMaxBuckets:
+			ip = newTokenBucket(l.cfg.PerIP, l.cfg.Burst)
+			l.ips[client] = ip
+		case l.cfg.PerSubnet == 0:
+			ip = l.ipOverflow
+		}
+		// otherwise the subnet bucket alone limits the client
+	}
+	if l.cfg.PerSubnet > 0 {
+		sn = l.subnets[subnet]
+		switch {
+		case sn != nil:
+		case len(l.subnets) < limiterMaxBuckets:
+			sn = newTokenBucket(l.cfg.PerSubnet, l.cfg.Burst)
+			l.subnets[subnet] = sn
+		default:
+			sn = l.subnetOverflow
+		}
+	}
+	l.mu.Unlock()
+
+	// a query the IP bucket turns away doesn't count against the subnet
+	if ip != nil && !ip.allow() {
+		return false
+	}
+	return sn == nil || sn.allow()
+}
+
+// sweep drops the refilled ones among a few buckets of each map, l.mu must
+// be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	n := 0
+	for k, b := range l.ips {
+		if n++; n > limiterSweepBatch {
+			break
+		}
+		if b.full(now) {
+			delete(l.ips, k)
+		}
+	}
+	n = 0
+	for k, b := range l.subnets {
+		if n++; n > limiterSweepBatch {
+			break
+		}
+		if b.full(now) {
+			delete(l.subnets, k)
+		}
+	}
+}
+
+// slip reports whether a limited UDP query gets a truncated answer rather
+// than none, and counts it.
+func (l *rateLimiter) slip() bool {
+	n := l.limited.Add(1)
+	slip := l.cfg.Slip > 0 && n%uint64(l.cfg.Slip) == 0
+	action := "dropped"
+	if slip {
+		action = "truncated"
+	}
+	metrics.RateLimited.WithLabelValues(l.proto, action, "client").Inc()
+	return slip
+}
+
+// refused counts a limited query answered with REFUSED or HTTP 429.
+func (l *rateLimiter) refused() {
+	metrics.RateLimited.WithLabelValues(l.proto, "refused", "client").Inc()
+}
+
+// userRefused counts a DoH query answered with HTTP 429 because its user is
+// over conf.AuthDohItem.RateLimit.
+func userRefused() {
+	metrics.RateLimited.WithLabelValues("doh", "refused", "user").Inc()
+}
+
+// refusedReply is the answer to a query over the limit on a stream listener.
+func refusedReply(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetRcode(req, dns.RcodeRefused)
+	return resp
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"df/conf"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 20)
+	for i := range 20 {
+		if !b.allow() {
+			t.Fatalf("query %d of the burst refused", i)
+		}
+	}
+	if b.allow() {
+		t.Fatal("query over the burst allowed")
+	}
+	if b.full(time.Now()) {
+		t.Error("empty bucket is full")
+	}
+
+	// half a second refills 5 tokens
+	b.last = b.last.Add(-500 * time.Millisecond)
+	for i := range 5 {
+		if !b.allow() {
+			t.Fatalf("refilled query %d refused", i)
+		}
+	}
+	if b.allow() {
+		t.Fatal("query over the refill allowed")
+	}
+	if !b.full(time.Now().Add(2 * time.Second)) {
+		t.Error("bucket not full after refilling the whole burst")
+	}
+
+	// the burst is at least the rate
+	if b := newTokenBucket(10, 1); b.burst != 10 || b.tokens != 10 {
+		t.Errorf("burst %v tokens %v, want 10", b.burst, b.tokens)
+	}
+}
+
+func TestRateLimiterAllowed(t *testing.T) {
+	type query struct {
+		client string
+		want   bool
+	}
+	tests := []struct {
+		name    string
+		cfg     conf.RateLimitConfig
+		queries []query
+	}{
+		{
+			name: "per ip",
+			cfg:  conf.RateLimitConfig{PerIP: 2, IPv4Prefix: 24, IPv6Prefix: 56},
+			queries: []query{
+				{"192.0.2.1", true}, {"192.0.2.1", true}, {"192.0.2.1", false},
+				{"192.0.2.2", true}, {"192.0.2.2", true}, {"192.0.2.2", false},
+			},
+		},
+		{
+			name: "per subnet",
+			cfg:  conf.RateLimitConfig{PerSubnet: 3, IPv4Prefix: 24, IPv6Prefix: 56},
+			queries: []query{
+				{"192.0.2.1", true}, {"192.0.2.2", true}, {"192.0.2.3", true}, {"192.0.2.4", false},
+				{"198.51.100.1", true},
+				{"2001:db8:0:1::1", true}, {"2001:db8:0:2::1", true}, {"2001:db8:0:3::1", true},
+				{"2001:db8:0:100::1", true},
+			},
+		},
+		{
+			name: "ip limit first",
+			cfg:  conf.RateLimitConfig{PerIP: 1, PerSubnet: 2, IPv4Prefix: 24, IPv6Prefix: 56},
+			queries: []query{
+				{"192.0.2.1", true}, {"192.0.2.1", false}, {"192.0.2.1", false},
+				// the refused ones didn't take from the subnet
+				{"192.0.2.2", true}, {"192.0.2.3", false},
+			},
+		},
+		{
+			name: "allow list",
+			cfg: conf.RateLimitConfig{PerIP: 1, IPv4Prefix: 24, IPv6Prefix: 56,
+				AllowPrefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/28")}},
+			queries: []query{
+				{"192.0.2.1", true}, {"192.0.2.1", true}, {"192.0.2.1", true},
+				{"192.0.2.100", true}, {"192.0.2.100", false},
+			},
+		},
+		{
+			name:    "no client address",
+			cfg:     conf.RateLimitConfig{PerIP: 1, IPv4Prefix: 24, IPv6Prefix: 56},
+			queries: []query{{"", true}, {"", true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter("test", tt.cfg)
+			for i, q := range tt.queries {
+				var client netip.Addr
+				if q.client != "" {
+					client = netip.MustParseAddr(q.client)
+				}
+				if got := l.allowed(client); got != q.want {
+					t.Errorf("query %d from %s allowed = %t, want %t", i, q.client, got, q.want)
+				}
+			}
+		})
+	}
+
+	if l := newLimiter("test", conf.RateLimitConfig{}); l != nil || !l.allowed(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("unlimited listener got a limiter that refuses")
+	}
+}
+
+func TestRateLimiterOverflow(t *testing.T) {
+	l := newLimiter("test", conf.RateLimitConfig{PerIP: 1, IPv4Prefix: 24, IPv6Prefix: 56})
+	now := time.Now()
+	for i := range limiterMaxBuckets {
+		addr := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+		l.ips[addr] = &tokenBucket{rate: 1, burst: 1, last: now}
+	}
+
+	// new clients share the overflow bucket instead of growing the map
+	if !l.allowed(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("first new client refused")
+	}
+	if l.allowed(netip.MustParseAddr("192.0.2.2")) {
+		t.Error("second new client got a bucket of its own")
+	}
+	if len(l.ips) > limiterMaxBuckets {
+		t.Errorf("%d ip buckets, want at most %d", len(l.ips), limiterMaxBuckets)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := newLimiter("test", conf.RateLimitConfig{PerIP: 1, PerSubnet: 1, IPv4Prefix: 24, IPv6Prefix: 56})
+	client := netip.MustParseAddr("192.0.2.1")
+	l.allowed(client)
+	if len(l.ips) != 1 || len(l.subnets) != 1 {
+		t.Fatalf("%d ip and %d subnet buckets, want 1 each", len(l.ips), len(l.subnets))
+	}
+
+	l.mu.Lock()
+	l.sweep(time.Now())
+	if len(l.ips) != 1 || len(l.subnets) != 1 {
+		t.Error("sweep dropped a bucket in use")
+	}
+	l.sweep(time.Now().Add(2 * time.Second))
+	if len(l.ips) != 0 || len(l.subnets) != 0 {
+		t.Errorf("sweep left %d ip and %d subnet buckets, want none", len(l.ips), len(l.subnets))
+	}
+	l.mu.Unlock()
+}
+
+func TestRateLimiterSlip(t *testing.T) {
+	tests := []struct {
+		slip int
+		want []bool
+	}{
+		{2, []bool{false, true, false, true}},
+		{1, []bool{true, true, true}},
+		{-1, []bool{false, false, false}},
+	}
+	for _, tt := range tests {
+		l := newLimiter("test", conf.RateLimitConfig{PerIP: 1, Slip: tt.slip})
+		for i, want := range tt.want {
+			if got := l.slip(); got != want {
+				t.Errorf("slip %d, query %d: truncated = %t, want %t", tt.slip, i, got, want)
+			}
+		}
+	}
+}
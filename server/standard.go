@@ -1,128 +1,252 @@
 package server
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"sync"
 	"time"
 
+	"df/conf"
 	"df/core"
 
 	"github.com/miekg/dns"
 )
 
-func Standard(port int) error {
-	go func() {
-		if err := Udp(port); err != nil {
-			fmt.Printf("UDP server error: %v\n", err)
+// Standard runs the UDP and TCP listeners until ctx is done. Unix sockets
+// are served over TCP only.
+func Standard(ctx context.Context, addrs []string) error {
+	var udp []string
+	for _, addr := range addrs {
+		if !isUnix(addr) {
+			udp = append(udp, addr)
 		}
-	}()
+	}
 
-	go func() {
-		if err := Tcp(port); err != nil {
-			fmt.Printf("TCP server error: %v\n", err)
-		}
-	}()
-	select {}
+	runs := []func(context.Context) error{func(ctx context.Context) error {
+		return Tcp(ctx, addrs)
+	}}
+	if len(udp) > 0 {
+		runs = append(runs, func(ctx context.Context) error {
+			return Udp(ctx, udp)
+		})
+	}
+	return runAll(ctx, runs...)
 }
 
-func Udp(port int) error {
-	addr := fmt.Sprintf("0.0.0.0:%d", port)
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address %s: %w", addr, err)
+// udpBufPool holds read buffers for UDP queries, one per in-flight request.
+var udpBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, dns.DefaultMsgSize)
+		return &b
+	},
+}
+
+func Udp(ctx context.Context, addrs []string) error {
+	opts := conf.Info().Server.UDP
+
+	lc := net.ListenConfig{}
+	if opts.ReusePort {
+		lc.Control = reusePortControl
 	}
 
-	udpConn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return fmt.Errorf("failed to bind UDP address %s: %w", addr, err)
+	var conns []*net.UDPConn
+	closeAll := func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	for _, addr := range addrs {
+		for i := 0; i < opts.Sockets; i++ {
+			pc, err := lc.ListenPacket(ctx, "udp", addr)
+			if err != nil {
+				closeAll()
+				return fmt.Errorf("failed to bind UDP address %s: %w", addr, err)
+			}
+			conns = append(conns, pc.(*net.UDPConn))
+		}
 	}
-	defer udpConn.Close()
 
-	log.Printf("[info] Standard Server (TCP) started on: %s", addr)
+	// workers and limits are shared by all sockets of this listener
+	sem := make(chan struct{}, opts.Workers)
+	limit := newRateLimiter("udp")
+	access := newACL("udp")
+	var inflight sync.WaitGroup
 
-	buf := make([]byte, dns.MinMsgSize)
-	for {
-		n, clientAddr, err := udpConn.ReadFromUDP(buf)
-		if err != nil {
-			log.Printf("read error: %v\n", err)
-			continue
-		}
+	errCh := make(chan error, len(conns))
+	for _, c := range conns {
+		go func() {
+			errCh <- serveUDP(ctx, c, sem, &inflight, access, limit)
+		}()
+	}
 
-		req := new(dns.Msg)
-		if err := req.Unpack(buf[:n]); err != nil {
-			log.Printf("[error] bad dns packet: %v", err)
-			continue
-		}
+	slog.Info("standard server (UDP) started", "addr", addrs, "sockets", opts.Sockets)
+	var err error
+	pending := len(conns)
+	select {
+	case <-ctx.Done():
+	case err = <-errCh:
+		pending--
+	}
+
+	// stop reading but keep the sockets open, so the queries in flight can
+	// still be answered
+	for _, c := range conns {
+		_ = c.SetReadDeadline(time.Now())
+	}
+	for ; pending > 0; pending-- {
+		<-errCh
+	}
+	if !waitTimeout(&inflight, drainTimeout()) {
+		slog.Warn("udp: drain timed out", "addr", addrs)
+	}
+	closeAll()
+	return err
+}
 
-		resp, err := core.Core(req)
+func serveUDP(ctx context.Context, udpConn *net.UDPConn, sem chan struct{}, inflight *sync.WaitGroup, access *acl, limit *rateLimiter) error {
+	for {
+		bufp := udpBufPool.Get().(*[]byte)
+		n, remote, err := udpConn.ReadFromUDP(*bufp)
 		if err != nil {
-			log.Printf("Core error: %v\n", err)
+			udpBufPool.Put(bufp)
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				// another socket failed and Udp is shutting down
+				return nil
+			}
+			slog.Error("udp: read", "err", err)
 			continue
 		}
 
-		maxSize := dns.MinMsgSize
-		if o := req.IsEdns0(); o != nil {
-			if o.UDPSize() > 512 {
-				maxSize = int(o.UDPSize())
+		sem <- struct{}{}
+		inflight.Add(1)
+		go func() {
+			defer func() {
+				udpBufPool.Put(bufp)
+				<-sem
+				inflight.Done()
+			}()
+			handleUDP(udpConn, (*bufp)[:n], remote, access, limit)
+		}()
+	}
+}
+
+func handleUDP(udpConn *net.UDPConn, buf []byte, remote *net.UDPAddr, access *acl, limit *rateLimiter) {
+	client := clientAddr(remote)
+	if !access.permits(client) {
+		if resp := refusedHeader(buf); resp != nil && !access.drop {
+			if _, err := udpConn.WriteToUDP(resp, remote); err != nil {
+				slog.Debug("udp: write refused", "client", remote, "err", err)
 			}
 		}
-		resp.Truncate(maxSize)
-
-		msg, err := resp.Pack()
-		if err != nil {
-			log.Printf("[error] bad dns response: %v", err)
+		return
+	}
+	if !limit.allowed(client) {
+		if limit.slip() {
+			writeSlip(udpConn, buf, remote)
 		}
-		log.Printf("[info] query dns %v", resp.Answer)
-		_, err = udpConn.WriteToUDP(msg, clientAddr)
-		if err != nil {
-			return fmt.Errorf("write error: %w", err)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		slog.Debug("udp: bad dns packet", "client", remote, "err", err)
+		return
+	}
+
+	resp, err := core.Core(req, core.Client{Addr: client, Proto: "udp"})
+	if err != nil {
+		slog.Error("udp: core", "err", err)
+		return
+	}
+
+	maxSize := dns.MinMsgSize
+	if o := req.IsEdns0(); o != nil {
+		if o.UDPSize() > 512 {
+			maxSize = int(o.UDPSize())
 		}
 	}
-}
+	resp.Truncate(maxSize)
 
-func Tcp(port int) error {
-	addr := fmt.Sprintf("0.0.0.0:%d", port)
-	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	msg, err := resp.Pack()
 	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address %s: %w", addr, err)
+		slog.Error("udp: pack response", "err", err)
+		return
 	}
+	if _, err := udpConn.WriteToUDP(msg, remote); err != nil {
+		slog.Debug("udp: write response", "client", remote, "err", err)
+	}
+}
 
-	listener, err := net.ListenTCP("tcp", tcpAddr)
+// writeSlip answers a limited query with an empty truncated response, which
+// tells a real client to retry over TCP and gives a spoofed one nothing to
+// amplify.
+func writeSlip(udpConn *net.UDPConn, buf []byte, remote *net.UDPAddr) {
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil || req.Response {
+		return
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Truncated = true
+	msg, err := resp.Pack()
 	if err != nil {
-		return fmt.Errorf("failed to bind TCP address %s: %w", addr, err)
+		return
+	}
+	if _, err := udpConn.WriteToUDP(msg, remote); err != nil {
+		slog.Debug("udp: write slip", "client", remote, "err", err)
 	}
-	defer listener.Close()
+}
 
-	log.Printf("[info] Standard Server (TCP) started on: %s", addr)
-	for {
-		conn, err := listener.AcceptTCP()
-		if err != nil {
-			log.Printf("[error] tcp accept error: %v", err)
-		}
-		go handleTCPConn(conn)
+func Tcp(ctx context.Context, addrs []string) error {
+	ls, err := listenStreams(addrs, listenStream)
+	if err != nil {
+		return err
 	}
 
+	access := newACL("tcp")
+	limit := newRateLimiter("tcp")
+	slog.Info("standard server (TCP) started", "addr", addrs)
+	acceptAll(ctx, "tcp", ls, func(conn net.Conn) {
+		if !access.permits(clientAddr(conn.RemoteAddr())) {
+			access.reject(conn)
+			return
+		}
+		handleTCPConn(ctx, conn, limit)
+	})
+	return nil
 }
 
-func handleTCPConn(conn *net.TCPConn) {
+// handleTCPConn serves queries on conn until the client goes away or ctx is
+// done; a query already read is still answered.
+func handleTCPConn(ctx context.Context, conn net.Conn, limit *rateLimiter) {
 	defer conn.Close()
+	client := clientAddr(conn.RemoteAddr())
 	_ = conn.SetDeadline(time.Now().Add(15 * time.Second))
 	for {
+		// checked after the deadline is set, so a drain can't be missed
+		if ctx.Err() != nil {
+			return
+		}
 		lengthBuf := make([]byte, 2)
 		_, err := io.ReadFull(conn, lengthBuf)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
-				log.Printf("[info] tcp client closed connection")
+				slog.Debug("tcp: client closed connection")
 				return
 			}
 
 			var netErr net.Error
 			if errors.As(err, &netErr) && netErr.Timeout() {
-				log.Printf("[warn] tcp read timeout: %v", err)
+				slog.Debug("tcp: read timeout", "err", err)
 				return
 			}
 			return
@@ -130,32 +254,38 @@ func handleTCPConn(conn *net.TCPConn) {
 
 		msgLen := int(binary.BigEndian.Uint16(lengthBuf))
 		if msgLen == 0 || msgLen > 64*1024 {
-			log.Printf("[error] invalid dns length=%d", msgLen)
+			slog.Debug("tcp: invalid message length", "len", msgLen)
 			return
 		}
 
 		msgBuf := make([]byte, msgLen)
 		_, err = io.ReadFull(conn, msgBuf)
 		if err != nil {
-			log.Printf("[error] tcp read dns msg: %v", err)
+			slog.Debug("tcp: read message", "err", err)
 			return
 		}
 
 		req := new(dns.Msg)
 		if err := req.Unpack(msgBuf); err != nil {
-			log.Printf("[error] bad dns packet: %v", err)
+			slog.Debug("tcp: bad dns packet", "err", err)
 			return
 		}
 
-		resp, err := core.Core(req)
-		if err != nil {
-			log.Printf("[error] core: %v", err)
-			return
+		var resp *dns.Msg
+		if limit.allowed(client) {
+			resp, err = core.Core(req, core.Client{Addr: client, Proto: "tcp"})
+			if err != nil {
+				slog.Error("tcp: core", "err", err)
+				return
+			}
+		} else {
+			limit.refused()
+			resp = refusedReply(req)
 		}
 
 		respMsg, err := resp.Pack()
 		if err != nil {
-			log.Printf("[error] pack response: %v", err)
+			slog.Error("tcp: pack response", "err", err)
 			return
 		}
 
@@ -165,7 +295,7 @@ func handleTCPConn(conn *net.TCPConn) {
 
 		_, err = conn.Write(out)
 		if err != nil {
-			log.Printf("[error] write tcp response: %v", err)
+			slog.Debug("tcp: write response", "err", err)
 			return
 		}
 